@@ -12,6 +12,7 @@ import (
 	"math"
 
 	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
 )
 
 var (
@@ -30,50 +31,252 @@ var (
 		Name:      "polls_total",
 		Help:      "Count of times autoscale polling loop runs.",
 	})
+	degradedMode = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "degraded_mode",
+		Help:      "Set to 1 when replicas are set by the fallback policy because queue statistics are not available.",
+	})
+)
+
+// Fallback modes applied when queue statistics are not available
+const (
+	// fallbackHold keeps the current number of replicas
+	fallbackHold = "hold"
+	// fallbackReplicas scales to a fixed number of replicas
+	fallbackReplicas = "replicas"
+	// fallbackMax scales to the upper limit of replicas
+	fallbackMax = "max"
 )
 
 type queueStats func() (*queueMetrics, error)
-type scaler func(int32) error
+type scaler func(*scaleDecision) error
 
 type scaleContext struct {
 	Threshold int
 	Coverage  float64
 	Interval  int
+	// Aggregation of queue lengths over the window compared with
+	// the threshold, average when not set
+	Aggregation string
+	// TargetAge is the maximum acceptable age of the oldest message in
+	// seconds, the age is not considered when set to 0
+	TargetAge float64
+	// Fallback mode is entered after FallbackAfter consecutive intervals
+	// without statistics, FallbackReplicas are used unless the mode is hold
+	Fallback         string
+	FallbackAfter    int
+	FallbackReplicas int32
+	// Window is the evaluation window in seconds, intervals without
+	// enough statistics are not counted for the fallback until the
+	// window has been filled once after start
+	Window int
 
 	Scaler scaler
+	// Clock is the system clock when not set
+	Clock clock
+	// Audit records every interval when set
+	Audit auditLog
+	// Leading reports whether this replica scales the resource, always
+	// when not set; the other replicas only follow the statistics
+	Leading func() bool
+
+	failures int
+	runs     int
+}
+
+// scaleDecision holds number of replicas computed from the average queue
+// length together with the inputs of the oldest message age policy
+type scaleDecision struct {
+	Replicas  int32   `json:"replicas"`
+	OldestAge float64 `json:"oldestAge"`
+	TargetAge float64 `json:"targetAge,omitempty"`
+	// Fallback is the fallback mode when Replicas don't come from
+	// the statistics
+	Fallback string `json:"fallback,omitempty"`
+	// Reason describes how Replicas were computed
+	Reason string `json:"reason,omitempty"`
+	// Event is recorded on the scaled resource when set
+	Event *scaleEvent `json:"-"`
+
+	// Current replicas of the resource, Desired after the message age
+	// policy and Scaled after the scale bounds named by Bound are set
+	// by the scaler
+	Current int32  `json:"current"`
+	Desired int32  `json:"desired"`
+	Scaled  int32  `json:"scaled"`
+	Bound   string `json:"bound,omitempty"`
+	// Ready replicas of the resource and the reason of holding scaling,
+	// the rollout in progress or replicas starting, are set by the scaler
+	Ready int32  `json:"ready"`
+	Held  string `json:"held,omitempty"`
+}
+
+// scaleEvent is a Kubernetes event describing the autoscaler state
+type scaleEvent struct {
+	Type    string
+	Reason  string
+	Message string
+}
+
+// size returns number of replicas for a resource running current replicas,
+// when the oldest message is older than the target age the replicas are
+// increased in proportion to the age
+func (d *scaleDecision) size(current int32) int32 {
+	if d.Fallback == fallbackHold {
+		return current
+	}
+	if len(d.Fallback) > 0 || d.TargetAge <= 0 || d.OldestAge <= d.TargetAge {
+		return d.Replicas
+	}
+	byAge := int32(math.Ceil(float64(current) * d.OldestAge / d.TargetAge))
+	return max(d.Replicas, max(byAge, current+1))
+}
+
+// hold keeps the current replicas for the reason held, no scale bound
+// limits the replicas which are not scaled
+func (d *scaleDecision) hold(held string) {
+	d.Held, d.Scaled, d.Bound = held, d.Current, ""
+}
+
+// reason describes how the replicas were computed, including the oldest
+// message age policy and the scale bound which limited them once the
+// decision has been applied by the scaler
+func (d *scaleDecision) reason() string {
+	reason := d.Reason
+	if len(d.Fallback) == 0 && d.Desired != d.Replicas {
+		reason += fmt.Sprintf(", oldest message age %.0fs above target %.0fs", d.OldestAge, d.TargetAge)
+	}
+	if len(d.Bound) > 0 {
+		reason += fmt.Sprintf(", desired %d replicas limited by %s bound", d.Desired, d.Bound)
+	}
+	return reason
 }
 
 func autoscale(
 	fstats queueStats,
 	ctx *scaleContext,
 	quit <-chan struct{}) {
+	clk := ctx.Clock
+	if clk == nil {
+		clk = realClock{}
+	}
 	for {
 		select {
 		case <-quit:
 			return
-		case <-time.After(time.Duration(ctx.Interval) * time.Second):
+		case <-clk.After(time.Duration(ctx.Interval) * time.Second):
 			pollCount.Inc()
-			qStats, err := fstats()
-			if err != nil {
-				log.Println(err)
-				autoscaleErrors.Inc()
-				continue
+			rec := ctx.run(fstats, clk.Now())
+			if rec != nil && ctx.Audit != nil {
+				if err := ctx.Audit.Record(rec); err != nil {
+					log.Printf("Failed to record scaling decision: %v", err)
+				}
 			}
+		}
+	}
+}
 
-			replicas, err := ctx.newSize(qStats.Average, qStats.Coverage)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-			desiredReplicas.Set(float64(replicas))
+// run decides on the size for the interval and scales the resource,
+// returns the audit record of the interval; replicas which are not leading
+// only decide, to keep counting intervals without statistics for the
+// fallback when they take over, and return nil
+func (ctx *scaleContext) run(fstats queueStats, now time.Time) *auditRecord {
+	qStats, d, err := ctx.decide(fstats)
+	if ctx.Leading != nil && !ctx.Leading() {
+		return nil
+	}
+	rec := &auditRecord{Time: now, Metrics: qStats, Decision: d}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if d == nil {
+		return rec
+	}
+	if err := ctx.Scaler(d); err != nil {
+		log.Println(err)
+		autoscaleErrors.Inc()
+		rec.Error = err.Error()
+	}
+	return rec
+}
 
-			err = ctx.Scaler(replicas)
-			if err != nil {
-				log.Println(err)
-				autoscaleErrors.Inc()
-			}
+// decide returns the statistics and the scale decision for the interval,
+// the decision is nil when there is nothing to do
+func (ctx *scaleContext) decide(fstats queueStats) (*queueMetrics, *scaleDecision, error) {
+	ctx.runs++
+	qStats, err := fstats()
+	if err != nil {
+		log.Println(err)
+		autoscaleErrors.Inc()
+		return nil, ctx.fallback(), err
+	}
+
+	size := qStats.aggregate(ctx.Aggregation)
+	replicas, err := ctx.newSize(size, qStats.Coverage)
+	if err != nil {
+		log.Println(err)
+		if ctx.warming() {
+			return qStats, nil, err
 		}
+		return qStats, ctx.fallback(), err
+	}
+	desiredReplicas.Set(float64(replicas))
+
+	agg := ctx.Aggregation
+	if len(agg) == 0 {
+		agg = aggAverage
+	}
+	d := &scaleDecision{Replicas: replicas,
+		OldestAge: qStats.OldestAge,
+		TargetAge: ctx.TargetAge,
+		Reason:    fmt.Sprintf("queue length %s %.2f, threshold %d", agg, size, ctx.Threshold)}
+	if ctx.degraded() {
+		log.Printf("Queue statistics available again after %d intervals, leaving degraded mode", ctx.failures)
+		degradedMode.Set(0)
+		d.Event = &scaleEvent{Type: v1.EventTypeNormal,
+			Reason:  "DegradedModeEnded",
+			Message: fmt.Sprintf("Queue statistics available again after %d intervals", ctx.failures)}
 	}
+	ctx.failures = 0
+	return qStats, d, nil
+}
+
+// fallback counts the interval without statistics, returns the fallback
+// decision once there were FallbackAfter of them in a row
+func (ctx *scaleContext) fallback() *scaleDecision {
+	ctx.failures++
+	if !ctx.degraded() {
+		return nil
+	}
+	d := &scaleDecision{Replicas: ctx.FallbackReplicas,
+		Fallback: ctx.Fallback,
+		Reason:   fmt.Sprintf("no queue statistics for %d intervals, fallback %s", ctx.failures, ctx.Fallback)}
+	if ctx.failures == ctx.FallbackAfter {
+		msg := fmt.Sprintf("No queue statistics for %d intervals, keeping current replicas", ctx.failures)
+		if ctx.Fallback != fallbackHold {
+			msg = fmt.Sprintf("No queue statistics for %d intervals, scaling to %d replicas", ctx.failures, ctx.FallbackReplicas)
+		}
+		log.Printf("Entering degraded mode: %s", msg)
+		degradedMode.Set(1)
+		d.Event = &scaleEvent{Type: v1.EventTypeWarning, Reason: "DegradedMode", Message: msg}
+	}
+	if d.Fallback == fallbackHold && d.Event == nil {
+		return nil
+	}
+	if d.Fallback != fallbackHold {
+		desiredReplicas.Set(float64(d.Replicas))
+	}
+	return d
+}
+
+// warming reports whether the window is still filling with samples taken
+// since start
+func (ctx *scaleContext) warming() bool {
+	return ctx.runs*ctx.Interval < ctx.Window
+}
+
+func (ctx *scaleContext) degraded() bool {
+	return ctx.FallbackAfter > 0 && ctx.failures >= ctx.FallbackAfter
 }
 
 func (ctx *scaleContext) newSize(avg float64, cov float64) (int32, error) {
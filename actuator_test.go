@@ -8,6 +8,9 @@ package main
 import (
 	"errors"
 	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestNewSizeNoCoverage(t *testing.T) {
@@ -32,6 +35,35 @@ func TestNewSize(t *testing.T) {
 	}
 }
 
+func TestScaleDecisionSize(t *testing.T) {
+	tests := []struct {
+		d       scaleDecision
+		current int32
+		want    int32
+	}{
+		{scaleDecision{Replicas: 2, OldestAge: 300}, 4, 2},
+		{scaleDecision{Replicas: 2, OldestAge: unknownAge, TargetAge: 60}, 4, 2},
+		{scaleDecision{Replicas: 2, OldestAge: 30, TargetAge: 60}, 4, 2},
+		{scaleDecision{Replicas: 2, OldestAge: 90, TargetAge: 60}, 4, 6},
+		{scaleDecision{Replicas: 2, OldestAge: 61, TargetAge: 60}, 0, 2},
+		{scaleDecision{Replicas: 0, OldestAge: 61, TargetAge: 60}, 0, 1},
+		{scaleDecision{Replicas: 9, OldestAge: 90, TargetAge: 60}, 4, 9},
+	}
+	for _, tt := range tests {
+		if got := tt.d.size(tt.current); got != tt.want {
+			t.Errorf("Expected size=%d for %+v with %d replicas, got: %d", tt.want, tt.d, tt.current, got)
+		}
+	}
+}
+
+func TestScaleDecisionReason(t *testing.T) {
+	d := &scaleDecision{Replicas: 2, OldestAge: 90, TargetAge: 60, Reason: "queue length p90 15.00, threshold 10",
+		Current: 4, Desired: 6, Scaled: 5, Bound: boundIncreaseLimit}
+	if got, want := d.reason(), "queue length p90 15.00, threshold 10, oldest message age 90s above target 60s, desired 6 replicas limited by increase-limit bound"; got != want {
+		t.Errorf("Expected reason='%s', got: '%s'", want, got)
+	}
+}
+
 func TestAutoscaleClosedChannel(t *testing.T) {
 	forever := make(chan struct{})
 	close(forever)
@@ -41,3 +73,173 @@ func TestAutoscaleClosedChannel(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestScaleDecisionSizeFallback(t *testing.T) {
+	if got, want := (&scaleDecision{Replicas: 8, Fallback: fallbackHold}).size(3), int32(3); got != want {
+		t.Errorf("Expected %d, got: %d", want, got)
+	}
+	d := &scaleDecision{Replicas: 8, Fallback: fallbackReplicas, OldestAge: 90, TargetAge: 60}
+	if got, want := d.size(3), int32(8); got != want {
+		t.Errorf("Expected %d, got: %d", want, got)
+	}
+}
+
+func TestScaleContextFallback(t *testing.T) {
+	ctx := &scaleContext{Coverage: 0.75, Threshold: 10, Fallback: fallbackReplicas, FallbackAfter: 2, FallbackReplicas: 5}
+	failing := func() (*queueMetrics, error) { return nil, errors.New("error") }
+
+	if _, d, _ := ctx.decide(failing); d != nil {
+		t.Fatalf("Expected no decision before fallback, got: %+v", d)
+	}
+	_, d, _ := ctx.decide(failing)
+	if d == nil {
+		t.Fatal("Expected fallback decision")
+	}
+	if got, want := d.Replicas, int32(5); got != want {
+		t.Errorf("Expected %d, got: %d", want, got)
+	}
+	if d.Event == nil || d.Event.Reason != "DegradedMode" {
+		t.Errorf("Expected DegradedMode event, got: %+v", d.Event)
+	}
+	if got, want := testutil.ToFloat64(degradedMode), 1.0; got != want {
+		t.Errorf("Expected degraded mode=%v, got: %v", want, got)
+	}
+	// the event is recorded once when entering degraded mode
+	if _, d, _ := ctx.decide(failing); d == nil || d.Event != nil {
+		t.Errorf("Expected fallback decision without event, got: %+v", d)
+	}
+
+	_, d, _ = ctx.decide(func() (*queueMetrics, error) { return &queueMetrics{Average: 25, Coverage: 1}, nil })
+	if d == nil {
+		t.Fatal("Expected decision")
+	}
+	if got, want := d.Replicas, int32(3); got != want {
+		t.Errorf("Expected %d, got: %d", want, got)
+	}
+	if d.Event == nil || d.Event.Reason != "DegradedModeEnded" {
+		t.Errorf("Expected DegradedModeEnded event, got: %+v", d.Event)
+	}
+	if got, want := testutil.ToFloat64(degradedMode), 0.0; got != want {
+		t.Errorf("Expected degraded mode=%v, got: %v", want, got)
+	}
+}
+
+func TestScaleContextFallbackHold(t *testing.T) {
+	ctx := &scaleContext{Coverage: 0.75, Threshold: 10, Fallback: fallbackHold, FallbackAfter: 1}
+	noCoverage := func() (*queueMetrics, error) { return &queueMetrics{Coverage: 0.1}, nil }
+
+	_, d, _ := ctx.decide(noCoverage)
+	if d == nil || d.Event == nil {
+		t.Fatalf("Expected decision with event, got: %+v", d)
+	}
+	if got, want := d.Fallback, fallbackHold; got != want {
+		t.Errorf("Expected fallback='%s', got: '%s'", want, got)
+	}
+	// nothing to do while holding
+	if _, d, _ := ctx.decide(noCoverage); d != nil {
+		t.Errorf("Expected no decision, got: %+v", d)
+	}
+}
+
+func TestScaleContextFallbackWarming(t *testing.T) {
+	// the window of 5 intervals fills after the fallback would be applied
+	clk := newFakeClock(time.Unix(1500000000, 0))
+	store := newMemoryStore(clk, 50, 5)
+	ctx := &scaleContext{Coverage: 0.75, Threshold: 10, Interval: 10, Window: 50,
+		Fallback: fallbackMax, FallbackAfter: 2, FallbackReplicas: 10}
+	fstats := func() (*queueMetrics, error) { return store.Stats(50, 5) }
+
+	for i := 0; i < 5; i++ {
+		store.Add(25, unknownAge)
+		clk.Advance(5 * time.Second)
+		store.Add(25, unknownAge)
+		clk.Advance(5 * time.Second)
+		_, d, err := ctx.decide(fstats)
+		if i < 3 {
+			if err == nil || d != nil {
+				t.Fatalf("Expected error without decision while the window fills, got: %+v, %v", d, err)
+			}
+			continue
+		}
+		if d == nil || len(d.Fallback) > 0 {
+			t.Fatalf("Expected decision on statistics, got: %+v", d)
+		}
+	}
+	if got, want := ctx.failures, 0; got != want {
+		t.Errorf("Expected %d intervals without statistics, got: %d", want, got)
+	}
+
+	// intervals without enough statistics count once the window filled
+	ctx = &scaleContext{Coverage: 0.75, Threshold: 10, Interval: 10, Window: 20,
+		Fallback: fallbackMax, FallbackAfter: 2, FallbackReplicas: 10}
+	noCoverage := func() (*queueMetrics, error) { return &queueMetrics{Coverage: 0.1}, nil }
+	ctx.decide(noCoverage)
+	if _, d, _ := ctx.decide(noCoverage); d != nil {
+		t.Errorf("Expected no decision before fallback, got: %+v", d)
+	}
+	if _, d, _ := ctx.decide(noCoverage); d == nil || d.Fallback != fallbackMax {
+		t.Errorf("Expected fallback decision, got: %+v", d)
+	}
+}
+
+func TestScaleContextRun(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	var scaled *scaleDecision
+	ctx := &scaleContext{Coverage: 0.75, Threshold: 10, Scaler: func(d *scaleDecision) error {
+		scaled = d
+		d.Current, d.Desired, d.Scaled = 1, 3, 3
+		return errors.New("conflict")
+	}}
+	rec := ctx.run(func() (*queueMetrics, error) { return &queueMetrics{Average: 25, Coverage: 1}, nil }, now)
+	if scaled == nil || rec.Decision != scaled {
+		t.Fatalf("Expected scaled decision in record, got: %+v", rec)
+	}
+	if got, want := rec.Metrics.Average, 25.0; got != want {
+		t.Errorf("Expected average=%v, got: %v", want, got)
+	}
+	if got, want := rec.Decision.Reason, "queue length avg 25.00, threshold 10"; got != want {
+		t.Errorf("Expected reason='%s', got: '%s'", want, got)
+	}
+	if got, want := rec.Error, "conflict"; got != want {
+		t.Errorf("Expected error='%s', got: '%s'", want, got)
+	}
+	if !rec.Time.Equal(now) {
+		t.Errorf("Expected time=%v, got: %v", now, rec.Time)
+	}
+
+	rec = ctx.run(func() (*queueMetrics, error) { return &queueMetrics{Coverage: 0.1}, nil }, now)
+	if rec.Decision != nil || len(rec.Error) == 0 {
+		t.Errorf("Expected error without decision, got: %+v", rec)
+	}
+}
+
+func TestScaleContextRunFollower(t *testing.T) {
+	leading := false
+	scaled := 0
+	ctx := &scaleContext{Coverage: 0.75, Threshold: 10, Fallback: fallbackMax, FallbackAfter: 2, FallbackReplicas: 5,
+		Leading: func() bool { return leading },
+		Scaler: func(d *scaleDecision) error {
+			scaled++
+			return nil
+		}}
+	noStats := func() (*queueMetrics, error) { return nil, errors.New("broker unavailable") }
+	if rec := ctx.run(noStats, time.Now()); rec != nil {
+		t.Errorf("Expected no record of follower, got: %+v", rec)
+	}
+	if got, want := scaled, 0; got != want {
+		t.Errorf("Expected %d scalings, got: %d", want, got)
+	}
+
+	// the intervals without statistics are counted while following
+	leading = true
+	rec := ctx.run(noStats, time.Now())
+	if rec == nil || rec.Decision == nil {
+		t.Fatalf("Expected fallback decision, got: %+v", rec)
+	}
+	if got, want := rec.Decision.Fallback, fallbackMax; got != want {
+		t.Errorf("Expected fallback='%s', got: '%s'", want, got)
+	}
+	if got, want := scaled, 1; got != want {
+		t.Errorf("Expected %d scalings, got: %d", want, got)
+	}
+}
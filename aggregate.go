@@ -0,0 +1,107 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// Aggregations of queue lengths over the evaluation window
+const (
+	aggAverage      = "avg"
+	aggMax          = "max"
+	aggP50          = "p50"
+	aggP90          = "p90"
+	aggP99          = "p99"
+	aggLast         = "last"
+	aggEWMA         = "ewma"
+	aggTimeWeighted = "time-weighted"
+)
+
+// aggregations lists names of all the aggregations
+var aggregations = []string{aggAverage, aggMax, aggP50, aggP90, aggP99, aggLast, aggEWMA, aggTimeWeighted}
+
+// isAggregation reports whether name is a known aggregation
+func isAggregation(name string) bool {
+	for _, agg := range aggregations {
+		if agg == name {
+			return true
+		}
+	}
+	return false
+}
+
+// storedSample is a queue sample recorded at UnixMillis
+type storedSample struct {
+	UnixMillis int64
+	Count      int
+	Age        float64
+}
+
+// windowStats computes statistics of samples given in chronological order,
+// now is the end of the window in milliseconds
+func windowStats(samples []storedSample, now int64, duration, interval int) *queueMetrics {
+	metrics := queueMetrics{Count: len(samples), OldestAge: unknownAge}
+	metrics.Coverage = float64(metrics.Count) * float64(interval) / float64(duration)
+	if len(samples) == 0 {
+		return &metrics
+	}
+
+	values := make([]float64, len(samples))
+	var total, ages, weighted, weights float64
+	var aged int
+	// smoothing factor of EWMA with span of the expected number of samples
+	alpha := 2.0 / (float64(duration)/float64(interval) + 1)
+	for i, sample := range samples {
+		value := float64(sample.Count)
+		values[i] = value
+		total += value
+		if sample.Age >= 0 {
+			aged++
+			ages += sample.Age
+		}
+		if i == 0 {
+			metrics.EWMA = value
+		} else {
+			metrics.EWMA = alpha*value + (1-alpha)*metrics.EWMA
+		}
+		// each value holds until the next sample, the last one until now
+		end := now
+		if i+1 < len(samples) {
+			end = samples[i+1].UnixMillis
+		}
+		if weight := float64(end - sample.UnixMillis); weight > 0 {
+			weighted += value * weight
+			weights += weight
+		}
+	}
+	metrics.Average = total / float64(len(samples))
+	if aged > 0 {
+		metrics.OldestAge = ages / float64(aged)
+	}
+	metrics.Last = values[len(values)-1]
+	metrics.TimeWeighted = metrics.Last
+	if weights > 0 {
+		metrics.TimeWeighted = weighted / weights
+	}
+
+	sort.Float64s(values)
+	metrics.Max = values[len(values)-1]
+	metrics.P50 = percentile(values, 50)
+	metrics.P90 = percentile(values, 90)
+	metrics.P99 = percentile(values, 99)
+	return &metrics
+}
+
+// percentile returns the nearest-rank percentile p of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
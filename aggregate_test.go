@@ -0,0 +1,93 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestWindowStats(t *testing.T) {
+	// a spike of 100 messages held for 1 of 20 seconds
+	samples := []storedSample{
+		{UnixMillis: 0, Count: 10, Age: unknownAge},
+		{UnixMillis: 5000, Count: 100, Age: 40},
+		{UnixMillis: 6000, Count: 10, Age: 20},
+		{UnixMillis: 15000, Count: 20, Age: unknownAge},
+	}
+	stats := windowStats(samples, 20000, 20, 5)
+
+	tests := []struct {
+		agg  string
+		want float64
+	}{
+		{aggAverage, 35},
+		{aggMax, 100},
+		{aggP50, 10},
+		{aggP90, 100},
+		{aggP99, 100},
+		{aggLast, 20},
+		{aggTimeWeighted, 17},
+	}
+	for _, tt := range tests {
+		if got := stats.aggregate(tt.agg); got != tt.want {
+			t.Errorf("Expected %s='%v', got: '%v'", tt.agg, tt.want, got)
+		}
+	}
+	if got, want := stats.Count, 4; got != want {
+		t.Errorf("Expected count='%v', got: '%v'", want, got)
+	}
+	if got, want := stats.Coverage, 1.0; got != want {
+		t.Errorf("Expected coverage='%v', got: '%v'", want, got)
+	}
+	if got, want := stats.OldestAge, 30.0; got != want {
+		t.Errorf("Expected oldest age='%v', got: '%v'", want, got)
+	}
+	// alpha=0.4 for a span of 4 samples: 10, 46, 31.6, 26.96
+	if got, want := stats.EWMA, 26.96; math.Abs(got-want) > 1e-9 {
+		t.Errorf("Expected ewma='%v', got: '%v'", want, got)
+	}
+}
+
+func TestWindowStatsEmpty(t *testing.T) {
+	stats := windowStats(nil, 20000, 20, 5)
+	for _, agg := range aggregations {
+		if got := stats.aggregate(agg); got != 0 {
+			t.Errorf("Expected %s='0', got: '%v'", agg, got)
+		}
+	}
+	if got, want := stats.OldestAge, unknownAge; got != want {
+		t.Errorf("Expected oldest age='%v', got: '%v'", want, got)
+	}
+}
+
+func TestWindowStatsSingleSample(t *testing.T) {
+	stats := windowStats([]storedSample{{UnixMillis: 20000, Count: 7, Age: unknownAge}}, 20000, 20, 5)
+	if got, want := stats.TimeWeighted, 7.0; got != want {
+		t.Errorf("Expected time-weighted='%v', got: '%v'", want, got)
+	}
+	if got, want := stats.P99, 7.0; got != want {
+		t.Errorf("Expected p99='%v', got: '%v'", want, got)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	for p, want := range map[float64]float64{0: 1, 50: 5, 90: 9, 99: 10, 100: 10} {
+		if got := percentile(sorted, p); got != want {
+			t.Errorf("Expected p%v='%v', got: '%v'", p, want, got)
+		}
+	}
+}
+
+func TestIsAggregation(t *testing.T) {
+	if !isAggregation(aggP90) {
+		t.Errorf("Expected '%s' to be valid", aggP90)
+	}
+	if isAggregation("median") {
+		t.Error("Expected 'median' to be invalid")
+	}
+}
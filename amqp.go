@@ -6,10 +6,8 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"log"
-	"net/http"
+	"math"
 	"strings"
 	"time"
 
@@ -17,10 +15,6 @@ import (
 	"github.com/streadway/amqp"
 )
 
-type APIQueueInfo struct {
-	Messsages int `json:"messages"`
-}
-
 var (
 	queueCountSuccesses = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: namespace,
@@ -40,6 +34,14 @@ var (
 		},
 		[]string{"queue"},
 	)
+	oldestMessageAge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "oldest_message_age_seconds",
+			Help:      "Age of the message at the head of a queue.",
+		},
+		[]string{"queue"},
+	)
 	metricSaveFailures = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: namespace,
 		Name:      "metric_save_failures_total",
@@ -47,31 +49,106 @@ var (
 	})
 )
 
-type saveStat func(int) error
+// saveStat saves total number of messages on the queues and age in seconds
+// of the oldest message, age is negative when unknown
+type saveStat func(int, float64) error
+
+// unknownAge is the age of the oldest message when the source doesn't
+// provide timestamps
+const unknownAge = -1.0
+
+// queueLength returns number of messages on a named queue
+type queueLength func(string) (int, error)
+
+// brokerOptions holds settings for connections to RabbitMQ
+type brokerOptions struct {
+	CAFile   string
+	CertFile string
+	KeyFile  string
+	Insecure bool
+	Timeout  time.Duration
+
+	// ServerName overrides host name used to verify broker TLS certificate
+	ServerName string
+	// ExternalAuth authenticates with client certificate using SASL EXTERNAL
+	// mechanism instead of credentials from the URI
+	ExternalAuth bool
+}
+
+// queueSample is number of messages on a queue or error retrieving it
+type queueSample struct {
+	Name     string
+	Messages int
+	// HeadTimestamp is the timestamp of the message at the head of the
+	// queue, zero when the queue is empty or the timestamp is unknown
+	HeadTimestamp time.Time
+	Err           error
+}
+
+// age returns age of the oldest message on the queue in seconds
+func (s *queueSample) age(now time.Time) float64 {
+	if s.Messages == 0 {
+		return 0
+	}
+	if s.HeadTimestamp.IsZero() {
+		return unknownAge
+	}
+	return math.Max(now.Sub(s.HeadTimestamp).Seconds(), 0)
+}
+
+// queueSampler retrieves state of a named queue
+type queueSampler func(string) queueSample
+
+// lengthSampler adapts sources providing only number of messages
+func lengthSampler(flen queueLength) queueSampler {
+	return func(name string) queueSample {
+		msgs, err := flen(name)
+		return queueSample{Name: name, Messages: msgs, Err: err}
+	}
+}
+
+// queuePoll retrieves state of each of the named queues
+type queuePoll func([]string) []queueSample
+
+// pollEach polls the queues one by one
+func pollEach(fsample queueSampler) queuePoll {
+	return func(names []string) []queueSample {
+		samples := make([]queueSample, len(names))
+		for i, name := range names {
+			samples[i] = fsample(name)
+		}
+		return samples
+	}
+}
 
-func monitorQueue(uri string, names []string, interval int, f saveStat, quit <-chan struct{}) {
+func monitorQueue(clk clock, fpoll queuePoll, names []string, interval int, f saveStat, quit <-chan struct{}) {
 	for {
 		select {
 		case <-quit:
 			return
-		case <-time.After(time.Duration(interval) * time.Second):
+		case <-clk.After(time.Duration(interval) * time.Second):
 			totalMsgs := 0
+			oldestAge := unknownAge
 			errored := false
-			for _, name := range names {
-				msgs, err := getQueueLength(uri, name)
-				if err != nil {
+			now := clk.Now()
+			for _, sample := range fpoll(names) {
+				if sample.Err != nil {
 					queueCountFailures.Inc()
-					log.Printf("Failed to get queue length for queue %s: %v", name, err)
+					log.Printf("Failed to get queue length for queue %s: %v", sample.Name, sample.Err)
 					errored = true
 				} else {
-					totalMsgs += msgs
+					totalMsgs += sample.Messages
 					queueCountSuccesses.Inc()
-					currentQueueSize.WithLabelValues(name).Set(float64(msgs))
+					currentQueueSize.WithLabelValues(sample.Name).Set(float64(sample.Messages))
+					if age := sample.age(now); age >= 0 {
+						oldestMessageAge.WithLabelValues(sample.Name).Set(age)
+						oldestAge = math.Max(oldestAge, age)
+					}
 				}
 			}
 			// Only save metrics if both counts succeeded.
 			if errored == false {
-				err := f(totalMsgs)
+				err := f(totalMsgs, oldestAge)
 				if err != nil {
 					metricSaveFailures.Inc()
 					log.Printf("Error saving metrics: %v", err)
@@ -81,43 +158,8 @@ func monitorQueue(uri string, names []string, interval int, f saveStat, quit <-c
 	}
 }
 
-func getQueueLengthFromAPI(uri, name string) (int, error) {
-	apiQueueInfo := APIQueueInfo{}
-	err := doApiRequest(uri, name, &apiQueueInfo)
-	if err != nil {
-		return 0, err
-	}
-	return apiQueueInfo.Messsages, nil
-}
-
-func doApiRequest(uri, name string, apiQueueInfo *APIQueueInfo) error {
-	req, err := buildRequest(uri, name)
-	if err != nil {
-		return err
-	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	reader := new(bytes.Buffer)
-	reader.ReadFrom(resp.Body)
-	return json.Unmarshal(reader.Bytes(), &apiQueueInfo)
-}
-
-func buildRequest(uri, name string) (*http.Request, error) {
-	index := strings.LastIndex(uri, "/")
-	vhost := uri[index:]
-	uri = uri[:index]
-	uri = uri + "/api/queues" + vhost + "/" + name
-	return http.NewRequest("GET", uri, nil)
-}
-
-func getQueueLength(uri, name string) (int, error) {
-	if strings.HasPrefix(uri, "http") {
-		return getQueueLengthFromAPI(uri, name)
-	}
-	conn, err := amqp.Dial(uri)
+func getQueueLength(uri, name string, opts *brokerOptions) (int, error) {
+	conn, err := dialBroker(uri, opts)
 	if err != nil {
 		return 0, err
 	}
@@ -133,3 +175,36 @@ func getQueueLength(uri, name string) (int, error) {
 	}
 	return q.Messages, nil
 }
+
+// dialBroker opens connection to the broker, `amqps` URIs are dialed over TLS
+// with client certificates loaded on every connection to pick up rotated files
+func dialBroker(uri string, opts *brokerOptions) (*amqp.Connection, error) {
+	config := amqp.Config{Heartbeat: 10 * time.Second, Locale: "en_US"}
+	if opts.Timeout > 0 {
+		config.Dial = amqp.DefaultDial(opts.Timeout)
+	}
+	if opts.ExternalAuth {
+		config.SASL = []amqp.Authentication{&externalAuth{}}
+	}
+	if strings.HasPrefix(uri, "amqps://") {
+		tlsConf, err := tlsConfig(opts.CAFile, opts.CertFile, opts.KeyFile, opts.Insecure)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.ServerName = opts.ServerName
+		config.TLSClientConfig = tlsConf
+	}
+	return amqp.DialConfig(uri, config)
+}
+
+// externalAuth is SASL EXTERNAL mechanism, the broker authenticates
+// the client using its TLS certificate
+type externalAuth struct{}
+
+func (auth *externalAuth) Mechanism() string {
+	return "EXTERNAL"
+}
+
+func (auth *externalAuth) Response() string {
+	return ""
+}
@@ -19,7 +19,7 @@ import (
 )
 
 func TestGetQueueLengthNonExistentHost(t *testing.T) {
-	_, err := getQueueLength("amqp://non-existent-host//", "")
+	_, err := getQueueLength("amqp://non-existent-host//", "", &brokerOptions{})
 	if err == nil {
 		t.Fatalf("Error expected")
 	}
@@ -29,7 +29,7 @@ func TestGetQueueLengthNonExistentHost(t *testing.T) {
 }
 
 func TestGetQueueLengthNonExistentQueue(t *testing.T) {
-	_, err := getQueueLength(amqpURI(), "non-existent-queue")
+	_, err := getQueueLength(amqpURI(), "non-existent-queue", &brokerOptions{})
 	if err == nil {
 		t.Fatalf("Error expected")
 	}
@@ -63,7 +63,7 @@ func TestGetQueueLengthNoMsgs(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	msgs, err := getQueueLength(amqpURI(), tmpQ.Name)
+	msgs, err := getQueueLength(amqpURI(), tmpQ.Name, &brokerOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -119,7 +119,7 @@ func TestGetQueueLength(t *testing.T) {
 		}
 	}
 
-	msgs, err := getQueueLength(amqpURI(), tmpQ.Name)
+	msgs, err := getQueueLength(amqpURI(), tmpQ.Name, &brokerOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -137,12 +137,12 @@ func TestMonitorQueueClosedChannel(t *testing.T) {
 	forever := make(chan struct{}, 1)
 	close(forever)
 
-	f := func(i int) error {
+	f := func(i int, age float64) error {
 		t.Fatalf("Unexpected result %d", i)
 		return nil
 	}
 
-	monitorQueue("", []string{""}, 1, f, forever)
+	monitorQueue(realClock{}, brokerPoll(""), []string{""}, 1, f, forever)
 }
 
 func TestMonitorQueue(t *testing.T) {
@@ -189,7 +189,7 @@ func TestMonitorQueue(t *testing.T) {
 
 	forever := make(chan struct{}, 1)
 
-	f := func(i int) error {
+	f := func(i int, age float64) error {
 		if got, want := i, 10; got != want {
 			t.Errorf("Expected %d, got: %d", want, got)
 		}
@@ -197,7 +197,7 @@ func TestMonitorQueue(t *testing.T) {
 		return nil
 	}
 
-	monitorQueue(amqpURI(), []string{tmpQ.Name}, 1, f, forever)
+	monitorQueue(realClock{}, brokerPoll(amqpURI()), []string{tmpQ.Name}, 1, f, forever)
 
 	_, err = ch.QueueDelete(tmpQ.Name, false, false, true)
 	if err != nil {
@@ -266,7 +266,7 @@ func TestMonitorQueueWithTwoQueues(t *testing.T) {
 
 	forever := make(chan struct{}, 1)
 
-	f := func(i int) error {
+	f := func(i int, age float64) error {
 		if got, want := i, 20; got != want {
 			t.Errorf("Expected %d, got: %d", want, got)
 		}
@@ -274,7 +274,7 @@ func TestMonitorQueueWithTwoQueues(t *testing.T) {
 		return nil
 	}
 
-	monitorQueue(amqpURI(), queueNames, 1, f, forever)
+	monitorQueue(realClock{}, brokerPoll(amqpURI()), queueNames, 1, f, forever)
 
 	for _, name := range queueNames {
 		_, err = ch.QueueDelete(name, false, false, true)
@@ -288,14 +288,19 @@ func TestMonitorQueueGetQueueLengthError(t *testing.T) {
 
 	forever := make(chan struct{}, 1)
 
-	f := func(i int) error {
+	f := func(i int, age float64) error {
 		t.Fatalf("Unexpected result %d", i)
 		return nil
 	}
 
-	go monitorQueue("amqp://non-existent-host//", []string{"no-queue"}, 1, f, forever)
+	clk := newFakeClock(time.Now())
+	go monitorQueue(clk, brokerPoll("amqp://non-existent-host//"), []string{"no-queue"}, 1, f, forever)
 
-	time.Sleep(3 * time.Second)
+	for i := 0; i < 3; i++ {
+		clk.BlockUntil(1)
+		clk.Advance(time.Second)
+	}
+	clk.BlockUntil(1)
 	close(forever)
 
 }
@@ -327,16 +332,21 @@ func TestMonitorQueueSaveStatError(t *testing.T) {
 
 	forever := make(chan struct{}, 1)
 
-	f := func(i int) error {
+	f := func(i int, age float64) error {
 		if got, want := i, 0; got != want {
 			t.Errorf("Expected %d, got: %d", want, got)
 		}
 		return errors.New("Dummy error")
 	}
 
-	go monitorQueue(amqpURI(), []string{tmpQ.Name}, 1, f, forever)
+	clk := newFakeClock(time.Now())
+	go monitorQueue(clk, brokerPoll(amqpURI()), []string{tmpQ.Name}, 1, f, forever)
 
-	time.Sleep(3 * time.Second)
+	for i := 0; i < 3; i++ {
+		clk.BlockUntil(1)
+		clk.Advance(time.Second)
+	}
+	clk.BlockUntil(1)
 	close(forever)
 
 	_, err = ch.QueueDelete(tmpQ.Name, false, false, true)
@@ -346,3 +356,7 @@ func TestMonitorQueueSaveStatError(t *testing.T) {
 }
 
 func amqpURI() string { return os.Getenv("AMQP_URI") }
+
+func brokerPoll(uri string) queuePoll {
+	return pollEach(lengthSampler(func(name string) (int, error) { return getQueueLength(uri, name, &brokerOptions{}) }))
+}
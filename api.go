@@ -0,0 +1,171 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats of the API responses
+const (
+	formatJSON = "json"
+	formatCSV  = "csv"
+)
+
+// apiHandler serves queue samples and scaling decisions of the autoscaled
+// resource, audit is nil when the decisions are not recorded
+type apiHandler struct {
+	clock  clock
+	store  SampleStore
+	audit  auditLog
+	target string
+}
+
+// timelineSample is a queue sample returned by the API
+type timelineSample struct {
+	Time      time.Time `json:"time"`
+	Count     int       `json:"count"`
+	OldestAge float64   `json:"oldestAge"`
+}
+
+// register adds the API endpoints to mux
+func (h *apiHandler) register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/timeline", h.timeline)
+	mux.HandleFunc("/api/v1/decisions", h.decisions)
+}
+
+func (h *apiHandler) timeline(w http.ResponseWriter, r *http.Request) {
+	format, from, to, ok := h.params(w, r)
+	if !ok {
+		return
+	}
+	samples, err := h.store.Samples(from, to)
+	if err != nil {
+		log.Printf("Failed to read queue samples: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	timeline := make([]timelineSample, len(samples))
+	for i, s := range samples {
+		timeline[i] = timelineSample{Time: time.Unix(0, s.UnixMillis*int64(time.Millisecond)).UTC(), Count: s.Count, OldestAge: s.Age}
+	}
+	if format == formatJSON {
+		writeJSON(w, timeline)
+		return
+	}
+	rows := [][]string{{"time", "count", "oldest_age"}}
+	for _, s := range timeline {
+		rows = append(rows, []string{s.Time.Format(time.RFC3339Nano), strconv.Itoa(s.Count), formatFloat(s.OldestAge)})
+	}
+	writeCSV(w, rows)
+}
+
+func (h *apiHandler) decisions(w http.ResponseWriter, r *http.Request) {
+	format, from, to, ok := h.params(w, r)
+	if !ok {
+		return
+	}
+	if h.audit == nil {
+		http.Error(w, "scaling decisions are not recorded, set -audit-file or -db", http.StatusNotFound)
+		return
+	}
+	recs, err := h.audit.Query(h.target, from, to)
+	if err != nil {
+		log.Printf("Failed to read scaling decisions: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if format == formatJSON {
+		if recs == nil {
+			recs = []auditRecord{}
+		}
+		writeJSON(w, recs)
+		return
+	}
+	rows := [][]string{{"time", "target", "count", "average", "coverage", "oldest_age",
+		"replicas", "current", "desired", "scaled", "bound", "fallback", "error"}}
+	for _, rec := range recs {
+		row := []string{rec.Time.Format(time.RFC3339Nano), rec.Target, "", "", "", "", "", "", "", "", "", "", rec.Error}
+		if m := rec.Metrics; m != nil {
+			row[2], row[3], row[4], row[5] = strconv.Itoa(m.Count), formatFloat(m.Average), formatFloat(m.Coverage), formatFloat(m.OldestAge)
+		}
+		if d := rec.Decision; d != nil {
+			row[6], row[7], row[8], row[9] = formatInt(d.Replicas), formatInt(d.Current), formatInt(d.Desired), formatInt(d.Scaled)
+			row[10], row[11] = d.Bound, d.Fallback
+		}
+		rows = append(rows, row)
+	}
+	writeCSV(w, rows)
+}
+
+// params returns response format and time range of the request, `from`
+// defaults to an hour before now and `to` to now; writes the error
+// response when not ok
+func (h *apiHandler) params(w http.ResponseWriter, r *http.Request) (format string, from, to time.Time, ok bool) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	format = q.Get("format")
+	if len(format) == 0 {
+		format = formatJSON
+		if strings.Contains(r.Header.Get("Accept"), "text/csv") {
+			format = formatCSV
+		}
+	}
+	if format != formatJSON && format != formatCSV {
+		http.Error(w, fmt.Sprintf("invalid format '%s'", format), http.StatusBadRequest)
+		return
+	}
+
+	now := h.clock.Now()
+	var err error
+	for _, p := range []struct {
+		name, value string
+		t           *time.Time
+	}{{"from", "1h", &from}, {"to", "0s", &to}} {
+		if v := q.Get(p.name); len(v) > 0 {
+			p.value = v
+		}
+		if *p.t, err = parseTimeParam(p.value, now); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	return format, from, to, true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write API response: %v", err)
+	}
+}
+
+func writeCSV(w http.ResponseWriter, rows [][]string) {
+	w.Header().Set("Content-Type", "text/csv")
+	if err := csv.NewWriter(w).WriteAll(rows); err != nil {
+		log.Printf("Failed to write API response: %v", err)
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func formatInt(i int32) string {
+	return strconv.FormatInt(int64(i), 10)
+}
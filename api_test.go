@@ -0,0 +1,141 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type memoryAudit []auditRecord
+
+func (a *memoryAudit) Record(rec *auditRecord) error {
+	*a = append(*a, *rec)
+	return nil
+}
+
+func (a *memoryAudit) Query(target string, from, to time.Time) ([]auditRecord, error) {
+	var recs []auditRecord
+	for _, rec := range *a {
+		if inRange(&rec, target, from, to) {
+			recs = append(recs, rec)
+		}
+	}
+	return recs, nil
+}
+
+func (a *memoryAudit) Close() error {
+	return nil
+}
+
+func newTestAPI() *apiHandler {
+	clk := newFakeClock(time.Unix(1500000000, 0))
+	store := newMemoryStore(clk, 60, 5)
+	audit := &memoryAudit{}
+	for i := 0; i < 3; i++ {
+		store.Add(i*10, float64(i))
+		audit.Record(&auditRecord{Time: clk.Now(), Target: "default/Deployment/worker",
+			Metrics:  &queueMetrics{Count: i + 1, Average: 5, Coverage: 1},
+			Decision: &scaleDecision{Replicas: int32(i + 1), Current: 1, Desired: int32(i + 1), Scaled: int32(i + 1)}})
+		clk.Advance(5 * time.Second)
+	}
+	return &apiHandler{clock: clk, store: store, audit: audit, target: "default/Deployment/worker"}
+}
+
+func serveAPI(h *apiHandler, req *http.Request) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	h.register(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAPITimeline(t *testing.T) {
+	h := newTestAPI()
+	rec := serveAPI(h, httptest.NewRequest("GET", "/api/v1/timeline?from=12s", nil))
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("Expected status %d, got: %d %s", want, got, rec.Body.String())
+	}
+	var samples []timelineSample
+	if err := json.Unmarshal(rec.Body.Bytes(), &samples); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(samples), 2; got != want {
+		t.Fatalf("Expected %d samples, got: %d", want, got)
+	}
+	if got, want := samples[1].Count, 20; got != want {
+		t.Errorf("Expected count=%d, got: %d", want, got)
+	}
+	if got, want := samples[1].Time, time.Unix(1500000010, 0).UTC(); !got.Equal(want) {
+		t.Errorf("Expected time=%v, got: %v", want, got)
+	}
+}
+
+func TestAPITimelineCSV(t *testing.T) {
+	h := newTestAPI()
+	req := httptest.NewRequest("GET", "/api/v1/timeline", nil)
+	req.Header.Set("Accept", "text/csv")
+	rec := serveAPI(h, req)
+	if got, want := rec.Header().Get("Content-Type"), "text/csv"; got != want {
+		t.Errorf("Expected content type='%s', got: '%s'", want, got)
+	}
+	want := "time,count,oldest_age\n" +
+		"2017-07-14T02:40:00Z,0,0\n" +
+		"2017-07-14T02:40:05Z,10,1\n" +
+		"2017-07-14T02:40:10Z,20,2\n"
+	if got := rec.Body.String(); got != want {
+		t.Errorf("Expected '%s', got: '%s'", want, got)
+	}
+}
+
+func TestAPIDecisions(t *testing.T) {
+	h := newTestAPI()
+	rec := serveAPI(h, httptest.NewRequest("GET", "/api/v1/decisions?from=2017-07-14T02:40:05Z&to=2017-07-14T02:40:10Z", nil))
+	var recs []auditRecord
+	if err := json.Unmarshal(rec.Body.Bytes(), &recs); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(recs), 1; got != want {
+		t.Fatalf("Expected %d decisions, got: %d", want, got)
+	}
+	if got, want := recs[0].Decision.Scaled, int32(2); got != want {
+		t.Errorf("Expected scaled=%d, got: %d", want, got)
+	}
+
+	rec = serveAPI(h, httptest.NewRequest("GET", "/api/v1/decisions?format=csv&from=6s", nil))
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if got, want := len(lines), 2; got != want {
+		t.Fatalf("Expected %d lines, got: %d", want, got)
+	}
+	if got, want := lines[1], "2017-07-14T02:40:10Z,default/Deployment/worker,3,5,1,0,3,1,3,3,,,"; got != want {
+		t.Errorf("Expected '%s', got: '%s'", want, got)
+	}
+}
+
+func TestAPIDecisionsNotRecorded(t *testing.T) {
+	h := newTestAPI()
+	h.audit = nil
+	rec := serveAPI(h, httptest.NewRequest("GET", "/api/v1/decisions", nil))
+	if got, want := rec.Code, http.StatusNotFound; got != want {
+		t.Errorf("Expected status %d, got: %d", want, got)
+	}
+}
+
+func TestAPIInvalidParams(t *testing.T) {
+	h := newTestAPI()
+	for _, url := range []string{"/api/v1/timeline?format=xml", "/api/v1/timeline?from=yesterday", "/api/v1/decisions?to=later"} {
+		if got, want := serveAPI(h, httptest.NewRequest("GET", url, nil)).Code, http.StatusBadRequest; got != want {
+			t.Errorf("Expected status %d for %s, got: %d", want, url, got)
+		}
+	}
+	if got, want := serveAPI(h, httptest.NewRequest("POST", "/api/v1/timeline", nil)).Code, http.StatusMethodNotAllowed; got != want {
+		t.Errorf("Expected status %d, got: %d", want, got)
+	}
+}
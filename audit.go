@@ -0,0 +1,312 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// compactInterval is the time between removals of expired records from
+// the audit file
+const compactInterval = time.Hour
+
+// auditRecord describes an autoscale interval: statistics, decision made
+// on them and result of scaling
+type auditRecord struct {
+	Time     time.Time      `json:"time"`
+	Target   string         `json:"target"`
+	Metrics  *queueMetrics  `json:"metrics,omitempty"`
+	Decision *scaleDecision `json:"decision,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// auditLog keeps records of autoscale intervals for the retention period
+type auditLog interface {
+	// Record saves the record of an interval of the log target
+	Record(rec *auditRecord) error
+	// Query returns records of target, all targets when empty, in the
+	// time range [from, to) in chronological order
+	Query(target string, from, to time.Time) ([]auditRecord, error)
+	Close() error
+}
+
+// fileAudit appends records as JSON lines to a file
+type fileAudit struct {
+	clock     clock
+	path      string
+	target    string
+	retention time.Duration
+	mu        sync.Mutex
+	file      *os.File
+	compacted time.Time
+}
+
+func newFileAudit(clk clock, path, target string, retention time.Duration) (*fileAudit, error) {
+	a := &fileAudit{clock: clk, path: path, target: target, retention: retention}
+	if err := a.compact(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *fileAudit) Record(rec *auditRecord) error {
+	rec.Target = a.target
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if a.clock.Now().Sub(a.compacted) >= compactInterval {
+		return a.compact()
+	}
+	return nil
+}
+
+func (a *fileAudit) Query(target string, from, to time.Time) ([]auditRecord, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return readAuditFile(a.path, target, from, to)
+}
+
+func (a *fileAudit) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// compact rewrites the file without records older than the retention
+// period and reopens it for appending
+func (a *fileAudit) compact() error {
+	now := a.clock.Now()
+	recs, err := readAuditFile(a.path, "", now.Add(-a.retention), time.Time{})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.Create(filepath.Join(filepath.Dir(a.path), "."+filepath.Base(a.path)+".tmp"))
+	if err != nil {
+		return err
+	}
+	if err := writeAuditRecords(tmp, recs); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+	if err := os.Rename(tmp.Name(), a.path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	a.file = f
+	a.compacted = now
+	return nil
+}
+
+// readAuditFile returns records of target from JSON lines file in the
+// time range [from, to), zero to is unbounded; missing file has no records
+func readAuditFile(path, target string, from, to time.Time) ([]auditRecord, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var recs []auditRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("invalid audit record in '%s': %v", path, err)
+		}
+		if inRange(&rec, target, from, to) {
+			recs = append(recs, rec)
+		}
+	}
+	return recs, scanner.Err()
+}
+
+func inRange(rec *auditRecord, target string, from, to time.Time) bool {
+	if len(target) > 0 && rec.Target != target {
+		return false
+	}
+	return !rec.Time.Before(from) && (to.IsZero() || rec.Time.Before(to))
+}
+
+// writeAuditRecords writes records as JSON lines
+func writeAuditRecords(w io.Writer, recs []auditRecord) error {
+	enc := json.NewEncoder(w)
+	for i := range recs {
+		if err := enc.Encode(&recs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqlAudit keeps records in the decisions table of the statistics database
+type sqlAudit struct {
+	clock     clock
+	db        *metricsDB
+	target    string
+	retention time.Duration
+}
+
+const insertDecisionSQL = `INSERT INTO decisions (target, ts_ms, record) VALUES (?, ?, ?)`
+
+const deleteDecisionsSQL = `DELETE FROM decisions WHERE target = ? AND ts_ms < ?`
+
+const queryDecisionsSQL = `SELECT record FROM decisions WHERE ts_ms >= ? AND ts_ms < ?`
+
+func (a *sqlAudit) Record(rec *auditRecord) error {
+	rec.Target = a.target
+	record, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(insertDecisionSQL, a.target, unixMillis(rec.Time), string(record)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(deleteDecisionsSQL, a.target, unixMillis(a.clock.Now().Add(-a.retention))); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (a *sqlAudit) Query(target string, from, to time.Time) ([]auditRecord, error) {
+	return queryDecisions(a.db, target, from, to)
+}
+
+// Close leaves the database open for the statistics store
+func (a *sqlAudit) Close() error {
+	return nil
+}
+
+// queryDecisions returns records of target from the database in the
+// time range [from, to)
+func queryDecisions(db *metricsDB, target string, from, to time.Time) ([]auditRecord, error) {
+	query := queryDecisionsSQL
+	args := []interface{}{unixMillis(from), unixMillis(to)}
+	if len(target) > 0 {
+		query += ` AND target = ?`
+		args = append(args, target)
+	}
+	rows, err := db.Query(query+` ORDER BY ts_ms`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recs []auditRecord
+	for rows.Next() {
+		var record string
+		if err := rows.Scan(&record); err != nil {
+			return nil, err
+		}
+		var rec auditRecord
+		if err := json.Unmarshal([]byte(record), &rec); err != nil {
+			return nil, fmt.Errorf("invalid audit record: %v", err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, rows.Err()
+}
+
+// parseTimeParam parses RFC3339 time or duration before now
+func parseTimeParam(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time '%s', expected RFC3339 time or duration before now", s)
+	}
+	return now.Add(-d), nil
+}
+
+// auditCommand prints records of the audit log in a time range as JSON
+// lines, args are the command line arguments after `audit`
+func auditCommand(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("audit", flag.ContinueOnError)
+	file := fs.String("audit-file", "", "JSON lines audit file to query")
+	db := fs.String("db", "", "sqlite3 database filename or PostgreSQL URL to query")
+	dir := fs.String("db-dir", "", "directory for sqlite3 database file")
+	target := fs.String("target", "", "autoscaled resource `namespace/kind/name`, all resources when not set")
+	from := fs.String("from", "1h", "start of the time range, RFC3339 time or duration before now")
+	to := fs.String("to", "0s", "end of the time range, RFC3339 time or duration before now")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	start, err := parseTimeParam(*from, now)
+	if err != nil {
+		return err
+	}
+	end, err := parseTimeParam(*to, now)
+	if err != nil {
+		return err
+	}
+
+	var recs []auditRecord
+	switch {
+	case len(*file) > 0:
+		recs, err = readAuditFile(*file, *target, start, end)
+	case len(*db) > 0:
+		path := *db
+		if len(*dir) > 0 && dialectOf(path) == sqliteDialect {
+			if path, err = dbPath(*dir, path); err != nil {
+				return err
+			}
+		}
+		var conn *metricsDB
+		if conn, err = connectToDB(&path); err != nil {
+			return err
+		}
+		defer conn.Close()
+		recs, err = queryDecisions(conn, *target, start, end)
+	default:
+		return errors.New("Missing audit file or database")
+	}
+	if err != nil {
+		return err
+	}
+	return writeAuditRecords(out, recs)
+}
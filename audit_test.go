@@ -0,0 +1,161 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAuditRecord(t time.Time, replicas int32) *auditRecord {
+	return &auditRecord{Time: t,
+		Metrics:  &queueMetrics{Count: 4, Average: 25, Coverage: 1, OldestAge: unknownAge},
+		Decision: &scaleDecision{Replicas: replicas, Current: 1, Desired: replicas, Scaled: replicas},
+	}
+}
+
+func TestFileAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+
+	clk := newFakeClock(time.Unix(1500000000, 0))
+	audit, err := newFileAudit(clk, path, "default/Deployment/worker", 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+
+	start := clk.Now()
+	for i := 0; i < 3; i++ {
+		if err := audit.Record(testAuditRecord(clk.Now(), int32(i+1))); err != nil {
+			t.Fatal(err)
+		}
+		clk.Advance(time.Hour)
+	}
+
+	recs, err := audit.Query("default/Deployment/worker", start.Add(time.Hour), clk.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(recs), 2; got != want {
+		t.Fatalf("Expected %d records, got: %d", want, got)
+	}
+	if got, want := recs[0].Decision.Replicas, int32(2); got != want {
+		t.Errorf("Expected replicas=%d, got: %d", want, got)
+	}
+	if got, want := recs[0].Target, "default/Deployment/worker"; got != want {
+		t.Errorf("Expected target='%s', got: '%s'", want, got)
+	}
+	if recs, _ := audit.Query("default/Deployment/other", start, clk.Now()); len(recs) != 0 {
+		t.Errorf("Expected no records of other target, got: %d", len(recs))
+	}
+
+	// the first record expires with compaction on the next record
+	if err := audit.Record(testAuditRecord(clk.Now(), 4)); err != nil {
+		t.Fatal(err)
+	}
+	recs, err = readAuditFile(path, "", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(recs), 3; got != want {
+		t.Errorf("Expected %d records after compaction, got: %d", want, got)
+	}
+}
+
+func TestSQLAudit(t *testing.T) {
+	clk := newFakeClock(time.Unix(1500000000, 0))
+	store, err := newSQLStore(clk, ":memory:", testSeries, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	audit := &sqlAudit{clock: clk, db: store.db, target: testSeries.Target, retention: 90 * time.Minute}
+
+	start := clk.Now()
+	for i := 0; i < 3; i++ {
+		if err := audit.Record(testAuditRecord(clk.Now(), int32(i+1))); err != nil {
+			t.Fatal(err)
+		}
+		clk.Advance(time.Hour)
+	}
+
+	recs, err := audit.Query("", start, clk.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first record is older than retention when the third is recorded
+	if got, want := len(recs), 2; got != want {
+		t.Fatalf("Expected %d records, got: %d", want, got)
+	}
+	if got, want := recs[1].Decision.Replicas, int32(3); got != want {
+		t.Errorf("Expected replicas=%d, got: %d", want, got)
+	}
+	if got, want := recs[1].Metrics.Average, 25.0; got != want {
+		t.Errorf("Expected average=%v, got: %v", want, got)
+	}
+}
+
+func TestParseTimeParam(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	got, err := parseTimeParam("2h", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := now.Add(-2 * time.Hour); !got.Equal(want) {
+		t.Errorf("Expected %v, got: %v", want, got)
+	}
+	got, err = parseTimeParam("2017-07-14T02:40:00Z", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(now) {
+		t.Errorf("Expected %v, got: %v", now, got)
+	}
+	if _, err := parseTimeParam("yesterday", now); err == nil {
+		t.Fatal("Expected error")
+	}
+}
+
+func TestAuditCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+
+	now := time.Now()
+	var buf bytes.Buffer
+	writeAuditRecords(&buf, []auditRecord{*testAuditRecord(now.Add(-2*time.Hour), 1), *testAuditRecord(now.Add(-time.Minute), 2)})
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := auditCommand([]string{"-audit-file", path, "-from", "1h"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Count(out.String(), "\n"), 1; got != want {
+		t.Fatalf("Expected %d records, got: %d", want, got)
+	}
+	if !strings.Contains(out.String(), `"replicas":2`) {
+		t.Errorf("Expected the recent record, got: %s", out.String())
+	}
+
+	if err := auditCommand([]string{"-from", "1h"}, &out); err == nil {
+		t.Fatal("Expected error")
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Reasons of holding scaling up without capacity for new replicas
+const (
+	// heldUnschedulable is held while pods of the resource can't be scheduled
+	heldUnschedulable = "unschedulable"
+	// heldQuota is held without resource quota headroom for a replica
+	heldQuota = "quota"
+)
+
+// boundQuota limits scaling up to the replicas fitting the resource quotas
+const boundQuota = "quota"
+
+var (
+	scaleUpFrozen = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "scale_up_frozen",
+			Help:      "Whether scaling up is frozen without capacity for new replicas, by reason.",
+		},
+		[]string{"reason"},
+	)
+)
+
+// checkCapacity holds scaling up while pods of the resource selected by
+// selector can't be scheduled and limits it to replicas of template fitting
+// resource quotas of the namespace; the capacity is not checked when
+// reading pods or quotas fails
+func (t *kubeTarget) checkCapacity(d *scaleDecision, selector *v1.LabelSelector, template *corev1.PodTemplateSpec) {
+	if !t.CapacityCheck || len(d.Held) > 0 || d.Scaled <= d.Current {
+		setScaleUpFrozen("")
+		return
+	}
+
+	pending, err := unschedulablePods(t.client, t.Namespace, selector)
+	if err != nil {
+		log.Printf("Failed to check unschedulable pods of %s '%s': %v", t.Kind, t.Name, err)
+	} else if pending > 0 {
+		log.Printf("Holding %s '%s' at %d replicas instead of %d, %d pods can't be scheduled", t.Kind, t.Name, d.Current, d.Scaled, pending)
+		d.hold(heldUnschedulable)
+		setScaleUpFrozen(d.Held)
+		return
+	}
+
+	headroom, err := quotaHeadroom(t.client, t.Namespace, template)
+	if err != nil {
+		log.Printf("Failed to check resource quotas of namespace '%s': %v", t.Namespace, err)
+	} else if headroom == 0 {
+		log.Printf("Holding %s '%s' at %d replicas instead of %d, no resource quota headroom", t.Kind, t.Name, d.Current, d.Scaled)
+		d.hold(heldQuota)
+		setScaleUpFrozen(d.Held)
+		return
+	} else if headroom > 0 && d.Current+headroom < d.Scaled {
+		d.Scaled, d.Bound = d.Current+headroom, boundQuota
+	}
+	setScaleUpFrozen("")
+}
+
+// unschedulablePods returns number of pods selected by selector which
+// the scheduler failed to place
+func unschedulablePods(c kubernetes.Interface, ns string, selector *v1.LabelSelector) (int, error) {
+	s, err := v1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return 0, err
+	}
+	pods, err := c.CoreV1().Pods(ns).List(v1.ListOptions{LabelSelector: s.String()})
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != corev1.PodPending {
+			continue
+		}
+		for _, cond := range pod.Status.Conditions {
+			if cond.Type == corev1.PodScheduled && cond.Status == corev1.ConditionFalse && cond.Reason == corev1.PodReasonUnschedulable {
+				n++
+				break
+			}
+		}
+	}
+	return n, nil
+}
+
+// quotaHeadroom returns number of pods of template fitting the unused pods,
+// cpu and memory of the resource quotas in the namespace, -1 when not
+// limited by a quota
+func quotaHeadroom(c kubernetes.Interface, ns string, template *corev1.PodTemplateSpec) (int32, error) {
+	quotas, err := c.CoreV1().ResourceQuotas(ns).List(v1.ListOptions{})
+	if err != nil {
+		return 0, err
+	}
+	requests, limits := podResources(&template.Spec)
+	headroom := int32(-1)
+	for _, quota := range quotas.Items {
+		for name, hard := range quota.Status.Hard {
+			var perPod resource.Quantity
+			switch {
+			case name == corev1.ResourcePods || name == "count/pods":
+				perPod = *resource.NewQuantity(1, resource.DecimalSI)
+			case strings.HasPrefix(string(name), "limits."):
+				perPod = limits[corev1.ResourceName(strings.TrimPrefix(string(name), "limits."))]
+			default:
+				perPod = requests[corev1.ResourceName(strings.TrimPrefix(string(name), "requests."))]
+			}
+			if perPod.IsZero() {
+				continue
+			}
+			used := quota.Status.Used[name]
+			free := hard.MilliValue() - used.MilliValue()
+			n := int32(0)
+			if free > 0 {
+				n = int32(free / perPod.MilliValue())
+			}
+			if headroom < 0 || n < headroom {
+				headroom = n
+			}
+		}
+	}
+	return headroom, nil
+}
+
+// podResources returns requests and limits of a pod, the sum of its
+// containers or the largest init container
+func podResources(spec *corev1.PodSpec) (corev1.ResourceList, corev1.ResourceList) {
+	requests, limits := corev1.ResourceList{}, corev1.ResourceList{}
+	for _, c := range spec.Containers {
+		addResources(requests, c.Resources.Requests)
+		addResources(limits, c.Resources.Limits)
+	}
+	for _, c := range spec.InitContainers {
+		maxResources(requests, c.Resources.Requests)
+		maxResources(limits, c.Resources.Limits)
+	}
+	return requests, limits
+}
+
+func addResources(total, list corev1.ResourceList) {
+	for name, q := range list {
+		sum := total[name]
+		sum.Add(q)
+		total[name] = sum
+	}
+}
+
+func maxResources(total, list corev1.ResourceList) {
+	for name, q := range list {
+		if current, ok := total[name]; !ok || q.Cmp(current) > 0 {
+			total[name] = q.DeepCopy()
+		}
+	}
+}
+
+// setScaleUpFrozen exports the reason of freezing scale up, empty when
+// scaling up is not frozen
+func setScaleUpFrozen(reason string) {
+	for _, r := range []string{heldUnschedulable, heldQuota} {
+		value := 0.0
+		if r == reason {
+			value = 1
+		}
+		scaleUpFrozen.With(prometheus.Labels{"reason": r}).Set(value)
+	}
+}
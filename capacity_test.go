@@ -0,0 +1,163 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var testSelector = &v1.LabelSelector{MatchLabels: map[string]string{"app": "worker"}}
+
+// testPod returns pod of the worker app, unschedulable when pending
+func testPod(name string, pending bool) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{Name: name, Namespace: "jobs", Labels: map[string]string{"app": "worker"}},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	if pending {
+		pod.Status.Phase = corev1.PodPending
+		pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodScheduled,
+			Status: corev1.ConditionFalse,
+			Reason: corev1.PodReasonUnschedulable}}
+	}
+	return pod
+}
+
+func testQuota(hard, used corev1.ResourceList) *corev1.ResourceQuota {
+	return &corev1.ResourceQuota{
+		ObjectMeta: v1.ObjectMeta{Name: "compute", Namespace: "jobs"},
+		Status:     corev1.ResourceQuotaStatus{Hard: hard, Used: used},
+	}
+}
+
+var testTemplate = &corev1.PodTemplateSpec{
+	Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "worker",
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("500m"), corev1.ResourceMemory: resource.MustParse("256Mi")},
+			Limits:   corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("512Mi")},
+		}}}},
+}
+
+func TestUnschedulablePods(t *testing.T) {
+	other := testPod("other", true)
+	other.Labels["app"] = "other"
+	c := fake.NewSimpleClientset(testPod("worker-1", false), testPod("worker-2", true), other)
+	n, err := unschedulablePods(c, "jobs", testSelector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n, 1; got != want {
+		t.Errorf("Expected %d unschedulable pods, got: %d", want, got)
+	}
+}
+
+func TestQuotaHeadroom(t *testing.T) {
+	tests := []struct {
+		name  string
+		quota *corev1.ResourceQuota
+		want  int32
+	}{
+		{"cpu", testQuota(corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("4")},
+			corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("2500m")}), 3},
+		{"memory limits", testQuota(corev1.ResourceList{corev1.ResourceLimitsMemory: resource.MustParse("2Gi")},
+			corev1.ResourceList{corev1.ResourceLimitsMemory: resource.MustParse("1Gi")}), 2},
+		{"pods", testQuota(corev1.ResourceList{corev1.ResourcePods: resource.MustParse("10"), corev1.ResourceCPU: resource.MustParse("100")},
+			corev1.ResourceList{corev1.ResourcePods: resource.MustParse("10")}), 0},
+		{"exceeded", testQuota(corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")},
+			corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("2Gi")}), 0},
+		{"other resources", testQuota(corev1.ResourceList{corev1.ResourceServices: resource.MustParse("1"), corev1.ResourceLimitsCPU: resource.MustParse("1")},
+			corev1.ResourceList{}), -1},
+	}
+	for _, tt := range tests {
+		n, err := quotaHeadroom(fake.NewSimpleClientset(tt.quota), "jobs", testTemplate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != tt.want {
+			t.Errorf("Expected headroom=%d for %s quota, got: %d", tt.want, tt.name, n)
+		}
+	}
+
+	n, err := quotaHeadroom(fake.NewSimpleClientset(), "jobs", testTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n, int32(-1); got != want {
+		t.Errorf("Expected headroom=%d without quotas, got: %d", want, got)
+	}
+}
+
+func TestPodResources(t *testing.T) {
+	spec := &corev1.PodSpec{
+		Containers: []corev1.Container{
+			{Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("200m")}}},
+			{Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("300m")}}},
+		},
+		InitContainers: []corev1.Container{
+			{Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")}}},
+		},
+	}
+	requests, _ := podResources(spec)
+	cpu := requests[corev1.ResourceCPU]
+	if got, want := cpu.MilliValue(), int64(1000); got != want {
+		t.Errorf("Expected cpu=%dm, got: %dm", want, got)
+	}
+	spec.InitContainers = nil
+	requests, _ = podResources(spec)
+	cpu = requests[corev1.ResourceCPU]
+	if got, want := cpu.MilliValue(), int64(500); got != want {
+		t.Errorf("Expected cpu=%dm, got: %dm", want, got)
+	}
+}
+
+func TestCheckCapacity(t *testing.T) {
+	c := fake.NewSimpleClientset(testPod("worker-1", true))
+	target := &kubeTarget{Kind: deploymentKind, Namespace: "jobs", Name: "worker", CapacityCheck: true, client: c}
+
+	d := &scaleDecision{Current: 4, Desired: 6, Scaled: 6}
+	target.checkCapacity(d, testSelector, testTemplate)
+	if got, want := d.Held, heldUnschedulable; got != want {
+		t.Errorf("Expected held='%s', got: '%s'", want, got)
+	}
+	if got, want := d.Scaled, int32(4); got != want {
+		t.Errorf("Expected scaled=%d, got: %d", want, got)
+	}
+	if got, want := testutil.ToFloat64(scaleUpFrozen.With(prometheus.Labels{"reason": heldUnschedulable})), 1.0; got != want {
+		t.Errorf("Expected scale up frozen=%v, got: %v", want, got)
+	}
+
+	c = fake.NewSimpleClientset(testQuota(corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("2500m")},
+		corev1.ResourceList{corev1.ResourceRequestsCPU: resource.MustParse("2")}))
+	target.client = c
+	d = &scaleDecision{Current: 4, Desired: 6, Scaled: 6}
+	target.checkCapacity(d, testSelector, testTemplate)
+	if len(d.Held) > 0 {
+		t.Errorf("Expected scaling not to be held, got: '%s'", d.Held)
+	}
+	if got, want := d.Scaled, int32(5); got != want {
+		t.Errorf("Expected scaled=%d, got: %d", want, got)
+	}
+	if got, want := d.Bound, boundQuota; got != want {
+		t.Errorf("Expected bound='%s', got: '%s'", want, got)
+	}
+	if got, want := testutil.ToFloat64(scaleUpFrozen.With(prometheus.Labels{"reason": heldUnschedulable})), 0.0; got != want {
+		t.Errorf("Expected scale up frozen=%v, got: %v", want, got)
+	}
+
+	// scaling down is not checked
+	d = &scaleDecision{Current: 4, Desired: 2, Scaled: 2}
+	target.checkCapacity(d, testSelector, testTemplate)
+	if got, want := d.Scaled, int32(2); got != want {
+		t.Errorf("Expected scaled=%d, got: %d", want, got)
+	}
+}
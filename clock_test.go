@@ -0,0 +1,167 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock moved forward by tests, timers fire when the time
+// is advanced past their deadline
+type fakeClock struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []fakeTimer
+}
+
+type fakeTimer struct {
+	At time.Time
+	C  chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	c := &fakeClock{now: now}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeTimer{At: c.now.Add(d), C: ch})
+	c.cond.Broadcast()
+	return ch
+}
+
+// Advance moves the time forward and fires the timers due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.At.After(c.now) {
+			pending = append(pending, w)
+		} else {
+			w.C <- c.now
+		}
+	}
+	c.waiters = pending
+}
+
+// BlockUntil waits until n timers are pending, i.e. the loops using
+// the clock are done with the previous tick
+func (c *fakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.waiters) < n {
+		c.cond.Wait()
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	clk := newFakeClock(start)
+	ch := clk.After(5 * time.Second)
+
+	clk.Advance(4 * time.Second)
+	select {
+	case <-ch:
+		t.Fatal("Unexpected timer")
+	default:
+	}
+	clk.Advance(time.Second)
+	select {
+	case now := <-ch:
+		if got, want := now, start.Add(5*time.Second); !got.Equal(want) {
+			t.Errorf("Expected time='%v', got: '%v'", want, got)
+		}
+	default:
+		t.Fatal("Expected timer to fire")
+	}
+}
+
+// TestMonitorAndAutoscaleWindow runs the sampling and autoscale loops on
+// a fake clock, coverage of the window drops when polls start failing
+func TestMonitorAndAutoscaleWindow(t *testing.T) {
+	clk := newFakeClock(time.Unix(1500000000, 0))
+	store := newMemoryStore(clk, 20, 5)
+	src := fixedPoll{"a": {Messages: 30}, "b": {Messages: 10}}
+	var mu sync.Mutex
+	fpoll := func(names []string) []queueSample {
+		mu.Lock()
+		defer mu.Unlock()
+		return src.poll(names)
+	}
+
+	decisions := make(chan *scaleDecision, 10)
+	ctx := &scaleContext{Threshold: 10, Coverage: 0.75, Interval: 20, Clock: clk,
+		Scaler: func(d *scaleDecision) error {
+			decisions <- d
+			return nil
+		}}
+	quit := make(chan struct{})
+	defer close(quit)
+	go monitorQueue(clk, fpoll, []string{"a", "b"}, 5, store.Add, quit)
+	go autoscale(func() (*queueMetrics, error) { return store.Stats(20, 5) }, ctx, quit)
+
+	for i := 0; i < 4; i++ {
+		clk.BlockUntil(2)
+		clk.Advance(5 * time.Second)
+	}
+	clk.BlockUntil(2)
+	stats, err := store.Stats(20, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stats.Coverage, 1.0; got != want {
+		t.Errorf("Expected coverage='%v', got: '%v'", want, got)
+	}
+	select {
+	case d := <-decisions:
+		if got, want := d.Replicas, int32(4); got != want {
+			t.Errorf("Expected replicas=%d, got: %d", want, got)
+		}
+	default:
+		t.Fatal("Expected scale decision")
+	}
+
+	mu.Lock()
+	src["b"] = queueSample{Err: &managementError{Reason: reasonUnavailable}}
+	mu.Unlock()
+	for i := 0; i < 4; i++ {
+		clk.BlockUntil(2)
+		clk.Advance(5 * time.Second)
+	}
+	clk.BlockUntil(2)
+	stats, err = store.Stats(20, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first sample of the window is the one taken 20 seconds ago
+	if got, want := stats.Coverage, 0.25; got != want {
+		t.Errorf("Expected coverage='%v', got: '%v'", want, got)
+	}
+	select {
+	case d := <-decisions:
+		t.Errorf("Unexpected scale decision %+v", d)
+	default:
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+)
+
+// sqlDialect holds differences of the SQL databases storing samples,
+// queries are written with `?` placeholders
+type sqlDialect struct {
+	Name   string
+	Driver string
+	// Numbered placeholders `$1`, `$2`... replace `?`
+	Numbered bool
+	// LockSQL serializes schema migrations of concurrent autoscalers
+	// sharing the database until the end of the transaction
+	LockSQL string
+}
+
+var (
+	sqliteDialect   = &sqlDialect{Name: "sqlite3", Driver: "sqlite3"}
+	postgresDialect = &sqlDialect{Name: "postgres",
+		Driver:   "postgres",
+		Numbered: true,
+		LockSQL:  `SELECT pg_advisory_xact_lock(5672)`,
+	}
+)
+
+// dialectOf returns PostgreSQL dialect for `postgres://` URLs, SQLite
+// dialect for anything else
+func dialectOf(dsn string) *sqlDialect {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return postgresDialect
+	}
+	return sqliteDialect
+}
+
+// rebind rewrites `?` placeholders of the query for the dialect
+func (d *sqlDialect) rebind(query string) string {
+	if !d.Numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// metricsDB is a database of samples, queries are rebound for its dialect
+type metricsDB struct {
+	*sql.DB
+	dialect *sqlDialect
+}
+
+func (db *metricsDB) Prepare(query string) (*sql.Stmt, error) {
+	return db.DB.Prepare(db.dialect.rebind(query))
+}
+
+func (db *metricsDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.DB.Exec(db.dialect.rebind(query), args...)
+}
+
+func (db *metricsDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.Query(db.dialect.rebind(query), args...)
+}
+
+func (db *metricsDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.DB.QueryRow(db.dialect.rebind(query), args...)
+}
+
+func (db *metricsDB) Begin() (*metricsTx, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &metricsTx{Tx: tx, dialect: db.dialect}, nil
+}
+
+// metricsTx is a transaction on a database of samples
+type metricsTx struct {
+	*sql.Tx
+	dialect *sqlDialect
+}
+
+func (tx *metricsTx) Prepare(query string) (*sql.Stmt, error) {
+	return tx.Tx.Prepare(tx.dialect.rebind(query))
+}
+
+func (tx *metricsTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.Exec(tx.dialect.rebind(query), args...)
+}
+
+func (tx *metricsTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.dialect.rebind(query), args...)
+}
+
+func (tx *metricsTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRow(tx.dialect.rebind(query), args...)
+}
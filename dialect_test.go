@@ -0,0 +1,32 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import "testing"
+
+func TestDialectOf(t *testing.T) {
+	for dsn, want := range map[string]*sqlDialect{
+		"":                                      sqliteDialect,
+		"stats.db":                              sqliteDialect,
+		"file::memory:?cache=shared":            sqliteDialect,
+		"postgres://autoscaler@pg:5432/stats":   postgresDialect,
+		"postgresql://autoscaler@pg:5432/stats": postgresDialect,
+	} {
+		if got := dialectOf(dsn); got != want {
+			t.Errorf("Expected dialect='%s' for '%s', got: '%s'", want.Name, dsn, got.Name)
+		}
+	}
+}
+
+func TestRebind(t *testing.T) {
+	query := `DELETE FROM samples WHERE target = ? AND queue = ? AND ts_ms < ?`
+	if got, want := sqliteDialect.rebind(query), query; got != want {
+		t.Errorf("Expected query='%s', got: '%s'", want, got)
+	}
+	if got, want := postgresDialect.rebind(query), `DELETE FROM samples WHERE target = $1 AND queue = $2 AND ts_ms < $3`; got != want {
+		t.Errorf("Expected query='%s', got: '%s'", want, got)
+	}
+}
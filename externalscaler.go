@@ -0,0 +1,139 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"context"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+)
+
+// Messages and service of KEDA external scaler, mirroring package
+// externalscaler of KEDA's externalscaler.proto; fields keep the proto
+// field numbers so the messages are wire compatible
+
+// scaledObjectRef identifies the ScaledObject and its trigger metadata
+type scaledObjectRef struct {
+	Name           string            `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Namespace      string            `protobuf:"bytes,2,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	ScalerMetadata map[string]string `protobuf:"bytes,3,rep,name=scalerMetadata,proto3" json:"scalerMetadata,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *scaledObjectRef) Reset()         { *m = scaledObjectRef{} }
+func (m *scaledObjectRef) String() string { return proto.CompactTextString(m) }
+func (*scaledObjectRef) ProtoMessage()    {}
+
+type isActiveResponse struct {
+	Result bool `protobuf:"varint,1,opt,name=result,proto3" json:"result,omitempty"`
+}
+
+func (m *isActiveResponse) Reset()         { *m = isActiveResponse{} }
+func (m *isActiveResponse) String() string { return proto.CompactTextString(m) }
+func (*isActiveResponse) ProtoMessage()    {}
+
+type metricSpec struct {
+	MetricName string `protobuf:"bytes,1,opt,name=metricName,proto3" json:"metricName,omitempty"`
+	TargetSize int64  `protobuf:"varint,2,opt,name=targetSize,proto3" json:"targetSize,omitempty"`
+}
+
+func (m *metricSpec) Reset()         { *m = metricSpec{} }
+func (m *metricSpec) String() string { return proto.CompactTextString(m) }
+func (*metricSpec) ProtoMessage()    {}
+
+type getMetricSpecResponse struct {
+	MetricSpecs []*metricSpec `protobuf:"bytes,1,rep,name=metricSpecs,proto3" json:"metricSpecs,omitempty"`
+}
+
+func (m *getMetricSpecResponse) Reset()         { *m = getMetricSpecResponse{} }
+func (m *getMetricSpecResponse) String() string { return proto.CompactTextString(m) }
+func (*getMetricSpecResponse) ProtoMessage()    {}
+
+type getMetricsRequest struct {
+	ScaledObjectRef *scaledObjectRef `protobuf:"bytes,1,opt,name=scaledObjectRef,proto3" json:"scaledObjectRef,omitempty"`
+	MetricName      string           `protobuf:"bytes,2,opt,name=metricName,proto3" json:"metricName,omitempty"`
+}
+
+func (m *getMetricsRequest) Reset()         { *m = getMetricsRequest{} }
+func (m *getMetricsRequest) String() string { return proto.CompactTextString(m) }
+func (*getMetricsRequest) ProtoMessage()    {}
+
+type metricValue struct {
+	MetricName  string `protobuf:"bytes,1,opt,name=metricName,proto3" json:"metricName,omitempty"`
+	MetricValue int64  `protobuf:"varint,2,opt,name=metricValue,proto3" json:"metricValue,omitempty"`
+}
+
+func (m *metricValue) Reset()         { *m = metricValue{} }
+func (m *metricValue) String() string { return proto.CompactTextString(m) }
+func (*metricValue) ProtoMessage()    {}
+
+type getMetricsResponse struct {
+	MetricValues []*metricValue `protobuf:"bytes,1,rep,name=metricValues,proto3" json:"metricValues,omitempty"`
+}
+
+func (m *getMetricsResponse) Reset()         { *m = getMetricsResponse{} }
+func (m *getMetricsResponse) String() string { return proto.CompactTextString(m) }
+func (*getMetricsResponse) ProtoMessage()    {}
+
+// externalScalerServer is the server API of externalscaler.ExternalScaler
+type externalScalerServer interface {
+	IsActive(context.Context, *scaledObjectRef) (*isActiveResponse, error)
+	StreamIsActive(*scaledObjectRef, grpc.ServerStream) error
+	GetMetricSpec(context.Context, *scaledObjectRef) (*getMetricSpecResponse, error)
+	GetMetrics(context.Context, *getMetricsRequest) (*getMetricsResponse, error)
+}
+
+// externalScalerService is the service descriptor of
+// externalscaler.ExternalScaler
+var externalScalerService = grpc.ServiceDesc{
+	ServiceName: "externalscaler.ExternalScaler",
+	HandlerType: (*externalScalerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "IsActive", Handler: unaryHandler("IsActive", func() interface{} { return new(scaledObjectRef) },
+			func(srv externalScalerServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return srv.IsActive(ctx, req.(*scaledObjectRef))
+			})},
+		{MethodName: "GetMetricSpec", Handler: unaryHandler("GetMetricSpec", func() interface{} { return new(scaledObjectRef) },
+			func(srv externalScalerServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return srv.GetMetricSpec(ctx, req.(*scaledObjectRef))
+			})},
+		{MethodName: "GetMetrics", Handler: unaryHandler("GetMetrics", func() interface{} { return new(getMetricsRequest) },
+			func(srv externalScalerServer, ctx context.Context, req interface{}) (interface{}, error) {
+				return srv.GetMetrics(ctx, req.(*getMetricsRequest))
+			})},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "StreamIsActive", ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				ref := new(scaledObjectRef)
+				if err := stream.RecvMsg(ref); err != nil {
+					return err
+				}
+				return srv.(externalScalerServer).StreamIsActive(ref, stream)
+			}},
+	},
+	Metadata: "externalscaler.proto",
+}
+
+// unaryHandler returns handler of the named method decoding requests
+// created by newReq
+func unaryHandler(method string, newReq func() interface{},
+	call func(externalScalerServer, context.Context, interface{}) (interface{}, error)) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		req := newReq()
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			return call(srv.(externalScalerServer), ctx, req)
+		}
+		if interceptor == nil {
+			return handler(ctx, req)
+		}
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/externalscaler.ExternalScaler/" + method}
+		return interceptor(ctx, req, info, handler)
+	}
+}
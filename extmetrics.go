@@ -0,0 +1,279 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	external "k8s.io/metrics/pkg/apis/external_metrics/v1beta1"
+)
+
+// Metrics served through the external metrics API, labeled by queue
+const (
+	// externalQueueLength is queue length aggregated over the evaluation window
+	externalQueueLength = "queue-length"
+	// externalOldestAge is average age in seconds of the oldest message
+	externalOldestAge = "oldest-message-age"
+)
+
+// externalMetricsPath is the path of the external metrics API group version
+var externalMetricsPath = "/apis/" + external.SchemeGroupVersion.String()
+
+// queueStore keeps samples of a single queue
+type queueStore struct {
+	Queue string
+	Store SampleStore
+}
+
+// queueStores keeps samples of each of the queues separately
+type queueStores []queueStore
+
+// newQueueStores returns a store for each of the queues, with db the
+// samples are kept in series of target and queue in the database
+func newQueueStores(clk clock, db *metricsDB, target string, names []string, duration, interval int) queueStores {
+	stores := make(queueStores, 0, len(names))
+	for _, name := range names {
+		var store SampleStore = newMemoryStore(clk, duration, interval)
+		if db != nil {
+			store = &sqlStore{clock: clk, db: db, series: sampleSeries{Target: target, Queue: name}, duration: duration, shared: true}
+		}
+		stores = append(stores, queueStore{Queue: name, Store: store})
+	}
+	return stores
+}
+
+// poll wraps fpoll, successful samples are saved to the store of their
+// queue at the same time, so they are summed by a store of the queues
+func (qs queueStores) poll(clk clock, fpoll queuePoll) queuePoll {
+	return func(names []string) []queueSample {
+		samples := fpoll(names)
+		qs.save(clk.Now(), samples)
+		return samples
+	}
+}
+
+// pollTotal wraps fpoll like poll for stores summed into the total of the
+// queues, nothing is saved when a queue failed as no total is saved then
+func (qs queueStores) pollTotal(clk clock, fpoll queuePoll) queuePoll {
+	return func(names []string) []queueSample {
+		samples := fpoll(names)
+		for _, sample := range samples {
+			if sample.Err != nil {
+				return samples
+			}
+		}
+		qs.save(clk.Now(), samples)
+		return samples
+	}
+}
+
+func (qs queueStores) save(now time.Time, samples []queueSample) {
+	for _, sample := range samples {
+		if sample.Err != nil {
+			continue
+		}
+		for _, s := range qs {
+			if s.Queue != sample.Name {
+				continue
+			}
+			if err := s.Store.AddAt(now, sample.Messages, sample.age(now)); err != nil {
+				metricSaveFailures.Inc()
+				log.Printf("Error saving metrics of queue %s: %v", sample.Name, err)
+			}
+		}
+	}
+}
+
+func (qs queueStores) Close() error {
+	var err error
+	for _, s := range qs {
+		if e := s.Store.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// externalMetrics serves statistics of the queues through the Kubernetes
+// external metrics API, queues without enough samples in the window are
+// left out so an HPA holds its replicas instead of acting on partial data
+type externalMetrics struct {
+	clock       clock
+	stores      queueStores
+	duration    int
+	interval    int
+	coverage    float64
+	aggregation string
+}
+
+func (h *externalMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	if path == externalMetricsPath {
+		writeJSON(w, h.resources())
+		return
+	}
+	// namespaces/{namespace}/{metric}, the queues are not namespaced
+	rest := strings.TrimPrefix(path, externalMetricsPath+"/")
+	parts := strings.Split(rest, "/")
+	if rest == path || len(parts) != 3 || parts[0] != "namespaces" {
+		http.NotFound(w, r)
+		return
+	}
+	metric := parts[2]
+	if metric != externalQueueLength && metric != externalOldestAge {
+		http.Error(w, fmt.Sprintf("metric '%s' not found", metric), http.StatusNotFound)
+		return
+	}
+	selector, err := labels.Parse(r.URL.Query().Get("labelSelector"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	values, err := h.values(metric, selector)
+	if err != nil {
+		log.Printf("Failed to read external metric %s: %v", metric, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, values)
+}
+
+// resources returns discovery document of the external metrics API
+func (h *externalMetrics) resources() *v1.APIResourceList {
+	list := &v1.APIResourceList{
+		TypeMeta:     v1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"},
+		GroupVersion: external.SchemeGroupVersion.String(),
+	}
+	for _, name := range []string{externalQueueLength, externalOldestAge} {
+		list.APIResources = append(list.APIResources, v1.APIResource{Name: name,
+			Namespaced: true,
+			Kind:       "ExternalMetricValueList",
+			Verbs:      v1.Verbs{"get"}})
+	}
+	return list
+}
+
+// values returns the metric of queues matching selector on `queue` label
+func (h *externalMetrics) values(metric string, selector labels.Selector) (*external.ExternalMetricValueList, error) {
+	list := &external.ExternalMetricValueList{
+		TypeMeta: v1.TypeMeta{Kind: "ExternalMetricValueList", APIVersion: external.SchemeGroupVersion.String()},
+		Items:    []external.ExternalMetricValue{},
+	}
+	window := int64(h.duration)
+	for _, s := range h.stores {
+		metricLabels := map[string]string{"queue": s.Queue}
+		if !selector.Matches(labels.Set(metricLabels)) {
+			continue
+		}
+		stats, err := s.Store.Stats(h.duration, h.interval)
+		if err != nil {
+			return nil, err
+		}
+		if stats.Coverage < h.coverage {
+			log.Printf("Not enough metrics of queue %s, required at least %.2f was %.2f metrics ratio", s.Queue, h.coverage, stats.Coverage)
+			continue
+		}
+		value := stats.aggregate(h.aggregation)
+		if metric == externalOldestAge {
+			if stats.OldestAge < 0 {
+				continue
+			}
+			value = stats.OldestAge
+		}
+		list.Items = append(list.Items, external.ExternalMetricValue{MetricName: metric,
+			MetricLabels:  metricLabels,
+			Timestamp:     v1.NewTime(h.clock.Now()),
+			WindowSeconds: &window,
+			Value:         *resource.NewMilliQuantity(int64(math.Round(value*1000)), resource.DecimalSI),
+		})
+	}
+	return list, nil
+}
+
+// serveExternalMetrics serves handler over HTTPS with the certificate and
+// key files, self-signed certificate when not set; client certificates
+// signed by the CA file are required when set, any client is accepted
+// otherwise
+func serveExternalMetrics(addr string, handler http.Handler, certFile, keyFile, clientCAFile string) error {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(certFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	} else {
+		cert, err := selfSignedCert()
+		if err != nil {
+			return err
+		}
+		cfg.Certificates = []tls.Certificate{*cert}
+	}
+	if len(clientCAFile) > 0 {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no valid CA certificates found in '%s'", clientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		log.Printf("No client CA for the external metrics API on %s, requests of any client are accepted", addr)
+	}
+	server := &http.Server{Addr: addr, Handler: handler, TLSConfig: cfg}
+	return server.ListenAndServeTLS("", "")
+}
+
+// selfSignedCert generates a certificate valid for a year, for API
+// services registered with insecureSkipTLSVerify
+func selfSignedCert() (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "kube-amqp-autoscale"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
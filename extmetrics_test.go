@@ -0,0 +1,136 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	external "k8s.io/metrics/pkg/apis/external_metrics/v1beta1"
+)
+
+// newTestExternalMetrics samples queue `tasks` with known message age for
+// the whole window and queue `events` only once
+func newTestExternalMetrics() *externalMetrics {
+	clk := newFakeClock(time.Unix(1500000000, 0))
+	stores := queueStores{{Queue: "tasks", Store: newMemoryStore(clk, 20, 5)},
+		{Queue: "events", Store: newMemoryStore(clk, 20, 5)}}
+	names := []string{"tasks", "events"}
+	for i := 0; i < 4; i++ {
+		n := i
+		fpoll := func(names []string) []queueSample {
+			return []queueSample{{Name: "tasks", Messages: 10 * n, HeadTimestamp: clk.Now().Add(-time.Minute)},
+				{Name: "events", Messages: 5, Err: errors.New("unavailable")}}
+		}
+		if i == 3 {
+			fpoll = pollEach(lengthSampler(func(string) (int, error) { return 7, nil }))
+		}
+		stores.poll(clk, fpoll)(names)
+		clk.Advance(5 * time.Second)
+	}
+	return &externalMetrics{clock: clk, stores: stores, duration: 20, interval: 5, coverage: 0.75, aggregation: aggMax}
+}
+
+func getExternalMetric(t *testing.T, h *externalMetrics, path string) *external.ExternalMetricValueList {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("Expected status %d, got: %d %s", want, got, rec.Body.String())
+	}
+	var list external.ExternalMetricValueList
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	return &list
+}
+
+func TestExternalMetricsQueueLength(t *testing.T) {
+	h := newTestExternalMetrics()
+	list := getExternalMetric(t, h, "/apis/external.metrics.k8s.io/v1beta1/namespaces/jobs/queue-length")
+	// events queue has a single sample, not enough coverage
+	if got, want := len(list.Items), 1; got != want {
+		t.Fatalf("Expected %d items, got: %d", want, got)
+	}
+	item := list.Items[0]
+	if got, want := item.MetricLabels["queue"], "tasks"; got != want {
+		t.Errorf("Expected queue='%s', got: '%s'", want, got)
+	}
+	if got, want := item.Value.MilliValue(), int64(20000); got != want {
+		t.Errorf("Expected value=%dm, got: %dm", want, got)
+	}
+	if item.WindowSeconds == nil || *item.WindowSeconds != 20 {
+		t.Errorf("Expected window=20, got: %v", item.WindowSeconds)
+	}
+
+	list = getExternalMetric(t, h, "/apis/external.metrics.k8s.io/v1beta1/namespaces/jobs/queue-length?labelSelector=queue%3Devents")
+	if got, want := len(list.Items), 0; got != want {
+		t.Errorf("Expected %d items, got: %d", want, got)
+	}
+}
+
+func TestExternalMetricsOldestAge(t *testing.T) {
+	h := newTestExternalMetrics()
+	h.coverage = 0
+	list := getExternalMetric(t, h, "/apis/external.metrics.k8s.io/v1beta1/namespaces/jobs/oldest-message-age?labelSelector=queue+in+(tasks,events)")
+	// age of events queue is unknown, tasks queue was empty in the first
+	// sample and its age unknown in the last one
+	if got, want := len(list.Items), 1; got != want {
+		t.Fatalf("Expected %d items, got: %d", want, got)
+	}
+	if got, want := list.Items[0].Value.MilliValue(), int64(40000); got != want {
+		t.Errorf("Expected value=%dm, got: %dm", want, got)
+	}
+}
+
+func TestExternalMetricsDiscovery(t *testing.T) {
+	h := newTestExternalMetrics()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/apis/external.metrics.k8s.io/v1beta1", nil))
+	var list v1.APIResourceList
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := list.GroupVersion, "external.metrics.k8s.io/v1beta1"; got != want {
+		t.Errorf("Expected group version='%s', got: '%s'", want, got)
+	}
+	if got, want := len(list.APIResources), 2; got != want {
+		t.Errorf("Expected %d resources, got: %d", want, got)
+	}
+
+	for _, path := range []string{"/apis/external.metrics.k8s.io/v1beta1/namespaces/jobs/cpu",
+		"/apis/external.metrics.k8s.io/v1beta1/queue-length", "/api/v1/timeline"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if got, want := rec.Code, http.StatusNotFound; got != want {
+			t.Errorf("Expected status %d for %s, got: %d", want, path, got)
+		}
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/apis/external.metrics.k8s.io/v1beta1/namespaces/jobs/queue-length?labelSelector=queue+in", nil))
+	if got, want := rec.Code, http.StatusBadRequest; got != want {
+		t.Errorf("Expected status %d, got: %d", want, got)
+	}
+}
+
+func TestSelfSignedCert(t *testing.T) {
+	cert, err := selfSignedCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.NotAfter.After(time.Now().Add(364 * 24 * time.Hour)) {
+		t.Errorf("Expected certificate valid for a year, got: %v", parsed.NotAfter)
+	}
+}
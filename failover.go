@@ -0,0 +1,263 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/streadway/amqp"
+)
+
+var (
+	brokerUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "broker_up",
+			Help:      "Health of RabbitMQ cluster node, 1 when the last request succeeded.",
+		},
+		[]string{"node"},
+	)
+	lastSampleNode = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "last_sample_node",
+			Help:      "RabbitMQ cluster node which served the last queue length, set to 1 for that node.",
+		},
+		[]string{"node"},
+	)
+	brokerFailovers = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "broker_failovers_total",
+		Help:      "Number of times queue length requests failed over to another RabbitMQ cluster node.",
+	})
+)
+
+// queueSamples returns state of the named queues retrieved with a single
+// request, queues that don't exist are missing from the result
+type queueSamples func([]string) (map[string]queueSample, error)
+
+// brokerNode is a RabbitMQ cluster node with its health state
+type brokerNode struct {
+	Name string
+
+	fsample  queueSampler
+	bulk     queueSamples
+	failures int
+	retryAt  time.Time
+}
+
+// newBrokerNode creates node for AMQP broker or management API URI, bulk
+// requests are supported by the management API only
+func newBrokerNode(uri string, opts *brokerOptions, bulk bool) (*brokerNode, error) {
+	node := &brokerNode{Name: nodeName(uri)}
+	if strings.HasPrefix(uri, "http") {
+		mc, err := newManagementClient(uri, opts)
+		if err != nil {
+			return nil, err
+		}
+		node.fsample = mc.queueSample
+		if bulk {
+			node.bulk = mc.queueSamples
+		}
+	} else {
+		node.fsample = lengthSampler(func(name string) (int, error) { return getQueueLength(uri, name, opts) })
+	}
+	return node, nil
+}
+
+func (n *brokerNode) healthy(now time.Time) bool {
+	return n.failures == 0 || !now.Before(n.retryAt)
+}
+
+// brokerPool spreads queue length requests over RabbitMQ cluster nodes,
+// sticking to the last node that answered and rotating to the next one
+// on failure, failed nodes are skipped for RetryInterval
+type brokerPool struct {
+	RetryInterval time.Duration
+	// Clock is the system clock when not set
+	Clock clock
+
+	mu      sync.Mutex
+	nodes   []*brokerNode
+	current int
+}
+
+// newBrokerPool creates pool of nodes from broker or management API URIs,
+// with bulk set the management API is asked for all queues at once
+func newBrokerPool(uris []string, opts *brokerOptions, retry time.Duration, bulk bool) (*brokerPool, error) {
+	if len(uris) == 0 {
+		return nil, errors.New("at least one RabbitMQ URI is required")
+	}
+	p := &brokerPool{RetryInterval: retry}
+	for _, uri := range uris {
+		node, err := newBrokerNode(uri, opts, bulk)
+		if err != nil {
+			return nil, err
+		}
+		p.nodes = append(p.nodes, node)
+	}
+	return p, nil
+}
+
+// poll retrieves lengths of all the queues with a single request when
+// the node supports it, falling back to a request per queue only when it
+// doesn't; when the bulk request fails on every node all queues fail
+func (p *brokerPool) poll(names []string) []queueSample {
+	var found map[string]queueSample
+	disabled := false
+	err := p.do(func(node *brokerNode) error {
+		if node.bulk == nil {
+			return errNoBulk
+		}
+		var err error
+		found, err = node.bulk(names)
+		if err != nil && !isNodeFailure(err) && errorReason(err) != reasonAuth {
+			// e.g. broker version without filtering and pagination
+			log.Printf("Disabled bulk queue requests for RabbitMQ node %s: %v", node.Name, err)
+			node.bulk = nil
+			disabled = true
+		}
+		return err
+	})
+	if err == errNoBulk || disabled {
+		return pollEach(p.queueSample)(names)
+	}
+	samples := make([]queueSample, len(names))
+	for i, name := range names {
+		if err != nil {
+			samples[i] = queueSample{Name: name, Err: err}
+			continue
+		}
+		sample, ok := found[name]
+		if !ok {
+			sample = queueSample{Name: name, Err: &managementError{Reason: reasonNotFound, Status: http.StatusNotFound, Queue: name}}
+		}
+		samples[i] = sample
+	}
+	return samples
+}
+
+// queueSample asks healthy nodes for the state of the queue in turn,
+// starting with the node which served the last request
+func (p *brokerPool) queueSample(name string) queueSample {
+	var sample queueSample
+	err := p.do(func(node *brokerNode) error {
+		sample = node.fsample(name)
+		return sample.Err
+	})
+	sample.Err = err
+	return sample
+}
+
+// errNoBulk is returned by nodes not supporting bulk queue requests
+var errNoBulk = errors.New("bulk queue requests are not supported")
+
+// do runs f on healthy nodes until it succeeds or fails with an error
+// that isn't specific to the node
+func (p *brokerPool) do(f func(*brokerNode) error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	var lastErr error
+	tried := make([]bool, len(p.nodes))
+	// first pass skips unhealthy nodes, second gives them another chance
+	// when no healthy node is left
+	for pass := 0; pass < 2; pass++ {
+		for i := 0; i < len(p.nodes); i++ {
+			idx := (p.current + i) % len(p.nodes)
+			node := p.nodes[idx]
+			if tried[idx] || (pass == 0 && !node.healthy(now)) {
+				continue
+			}
+			tried[idx] = true
+			err := f(node)
+			if err == errNoBulk {
+				return err
+			}
+			if err == nil || !isNodeFailure(err) {
+				// the node answered, e.g. the queue does not exist
+				p.markUp(idx)
+				return err
+			}
+			lastErr = err
+			p.markDown(node, now, err)
+		}
+	}
+	return lastErr
+}
+
+func (p *brokerPool) now() time.Time {
+	if p.Clock == nil {
+		return time.Now()
+	}
+	return p.Clock.Now()
+}
+
+func (p *brokerPool) markUp(idx int) {
+	node := p.nodes[idx]
+	if idx != p.current {
+		brokerFailovers.Inc()
+		log.Printf("Failed over to RabbitMQ node %s", node.Name)
+		lastSampleNode.With(prometheus.Labels{"node": p.nodes[p.current].Name}).Set(0)
+		p.current = idx
+	}
+	node.failures = 0
+	brokerUp.With(prometheus.Labels{"node": node.Name}).Set(1)
+	lastSampleNode.With(prometheus.Labels{"node": node.Name}).Set(1)
+}
+
+func (p *brokerPool) markDown(node *brokerNode, now time.Time, err error) {
+	node.failures++
+	node.retryAt = now.Add(p.RetryInterval)
+	brokerUp.With(prometheus.Labels{"node": node.Name}).Set(0)
+	if len(p.nodes) > 1 {
+		log.Printf("RabbitMQ node %s failed %d times in a row: %v", node.Name, node.failures, err)
+	}
+}
+
+// isNodeFailure reports whether err means the node can't serve requests,
+// as opposed to errors any other node in the cluster would return
+func isNodeFailure(err error) bool {
+	switch e := err.(type) {
+	case *managementError:
+		return e.Reason == reasonUnavailable
+	case *amqp.Error:
+		return e.Code != amqp.NotFound && e.Code != amqp.AccessRefused
+	}
+	return true
+}
+
+// nodeName returns host and port of the URI without credentials
+func nodeName(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || len(u.Host) == 0 {
+		if i := strings.LastIndex(uri, "@"); i >= 0 {
+			return uri[i+1:]
+		}
+		return uri
+	}
+	return u.Host
+}
+
+// splitURIs splits comma separated list of URIs
+func splitURIs(uris string) []string {
+	var list []string
+	for _, uri := range strings.Split(unquoteURI(uris), ",") {
+		uri = unquoteURI(strings.TrimSpace(uri))
+		if len(uri) > 0 {
+			list = append(list, uri)
+		}
+	}
+	return list
+}
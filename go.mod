@@ -3,9 +3,14 @@ module github.com/mbogus/kube-amqp-autoscale
 go 1.14
 
 require (
+	github.com/golang/protobuf v1.3.2
+	github.com/lib/pq v1.3.0
 	github.com/mattn/go-sqlite3 v1.10.0
 	github.com/prometheus/client_golang v1.4.1
 	github.com/streadway/amqp v0.0.0-20200108173154-1c71cc93ed71
+	google.golang.org/grpc v1.27.1
+	k8s.io/api v0.17.3
 	k8s.io/apimachinery v0.17.3
 	k8s.io/client-go v0.17.3
+	k8s.io/metrics v0.17.3
 )
@@ -0,0 +1,196 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/util/jsonpath"
+)
+
+// queuePlaceholder is replaced with the queue name in HTTP source URLs
+const queuePlaceholder = "{queue}"
+
+// httpSource retrieves queue length from an arbitrary HTTP endpoint returning
+// JSON document, the number is extracted with a JSONPath expression
+type httpSource struct {
+	URL       string
+	JSONPath  string
+	Headers   http.Header
+	TokenFile string
+	CAFile    string
+	CertFile  string
+	KeyFile   string
+	Insecure  bool
+	Timeout   time.Duration
+
+	client *http.Client
+	path   *jsonpath.JSONPath
+}
+
+func (s *httpSource) init() error {
+	if s.path == nil {
+		if len(s.JSONPath) == 0 {
+			return errors.New("JSONPath expression must be defined")
+		}
+		p := jsonpath.New("queue-length")
+		if err := p.Parse(relaxedJSONPath(s.JSONPath)); err != nil {
+			return err
+		}
+		s.path = p
+	}
+	if s.client == nil {
+		c, err := newHTTPClient(s.CAFile, s.CertFile, s.KeyFile, s.Insecure, s.Timeout)
+		if err != nil {
+			return err
+		}
+		s.client = c
+	}
+	return nil
+}
+
+func newHTTPClient(caFile, certFile, keyFile string, insecure bool, timeout time.Duration) (*http.Client, error) {
+	tlsConf, err := tlsConfig(caFile, certFile, keyFile, insecure)
+	if err != nil {
+		return nil, err
+	}
+	return httpClient(tlsConf, timeout), nil
+}
+
+// httpClient returns client verifying servers and authenticating with tlsConf
+func httpClient(tlsConf *tls.Config, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConf},
+	}
+}
+
+// queueLength requests the URL, with placeholder replaced by the queue name,
+// and returns the sum of all numbers matched by the JSONPath expression
+func (s *httpSource) queueLength(name string) (int, error) {
+	if err := s.init(); err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("GET", strings.Replace(s.URL, queuePlaceholder, url.PathEscape(name), -1), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	for k, v := range s.Headers {
+		req.Header[k] = v
+	}
+	if len(s.TokenFile) > 0 {
+		// read on every request to pick up rotated tokens
+		token, err := ioutil.ReadFile(s.TokenFile)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return 0, fmt.Errorf("unexpected response from '%s%s': %s", req.URL.Host, req.URL.Path, resp.Status)
+	}
+
+	var data interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return 0, err
+	}
+	return s.extract(data)
+}
+
+func (s *httpSource) extract(data interface{}) (int, error) {
+	results, err := s.path.FindResults(data)
+	if err != nil {
+		return 0, err
+	}
+	sum := 0.0
+	found := false
+	for _, values := range results {
+		for _, v := range values {
+			n, err := jsonNumber(v)
+			if err != nil {
+				return 0, err
+			}
+			sum += n
+			found = true
+		}
+	}
+	if !found {
+		return 0, fmt.Errorf("JSONPath '%s' did not match any value", s.JSONPath)
+	}
+	return int(math.Round(sum)), nil
+}
+
+func jsonNumber(v reflect.Value) (float64, error) {
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Float64, reflect.Float32:
+		return v.Float(), nil
+	case reflect.Int, reflect.Int64, reflect.Int32:
+		return float64(v.Int()), nil
+	case reflect.String:
+		return strconv.ParseFloat(v.String(), 64)
+	}
+	return 0, fmt.Errorf("JSONPath value of kind %s is not a number", v.Kind())
+}
+
+// relaxedJSONPath accepts expressions without surrounding braces,
+// e.g. `.backlog.size` as `{.backlog.size}`
+func relaxedJSONPath(expr string) string {
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "{") {
+		return expr
+	}
+	if !strings.HasPrefix(expr, ".") && !strings.HasPrefix(expr, "$") {
+		expr = "." + expr
+	}
+	return "{" + expr + "}"
+}
+
+// headerFlags collects repeated `Name: value` command-line arguments
+type headerFlags http.Header
+
+func (h headerFlags) String() string {
+	var s []string
+	for k, values := range h {
+		for _, v := range values {
+			s = append(s, k+": "+v)
+		}
+	}
+	return strings.Join(s, ", ")
+}
+
+func (h headerFlags) Set(value string) error {
+	i := strings.Index(value, ":")
+	if i < 1 {
+		return fmt.Errorf("invalid HTTP header '%s', expected 'Name: value'", value)
+	}
+	http.Header(h).Add(strings.TrimSpace(value[:i]), strings.TrimSpace(value[i+1:]))
+	return nil
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHTTPSourceQueueLength(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.URL.Path, "/jobs/reports"; got != want {
+			t.Errorf("Expected path='%s', got: '%s'", want, got)
+		}
+		w.Write([]byte(`{"backlog": {"size": 42, "state": "running"}}`))
+	}))
+	defer ts.Close()
+
+	src := &httpSource{URL: ts.URL + "/jobs/{queue}", JSONPath: "{.backlog.size}"}
+	n, err := src.queueLength("reports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n, 42; got != want {
+		t.Errorf("Expected length=%d, got: %d", want, got)
+	}
+}
+
+func TestHTTPSourceQueueLengthSum(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"pools": [{"pending": 3}, {"pending": "4"}, {"pending": 5}]}`))
+	}))
+	defer ts.Close()
+
+	src := &httpSource{URL: ts.URL, JSONPath: ".pools[*].pending"}
+	n, err := src.queueLength("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n, 12; got != want {
+		t.Errorf("Expected length=%d, got: %d", want, got)
+	}
+}
+
+func TestHTTPSourceHeadersAndToken(t *testing.T) {
+	tokenFile, err := ioutil.TempFile(os.TempDir(), "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tokenFile.Name())
+	tokenFile.WriteString("s3cr3t\n")
+	tokenFile.Close()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.Header.Get("Authorization"), "Bearer s3cr3t"; got != want {
+			t.Errorf("Expected Authorization='%s', got: '%s'", want, got)
+		}
+		if got, want := r.Header.Get("X-Tenant"), "acme"; got != want {
+			t.Errorf("Expected X-Tenant='%s', got: '%s'", want, got)
+		}
+		w.Write([]byte(`{"count": 1}`))
+	}))
+	defer ts.Close()
+
+	headers := headerFlags{}
+	if err := headers.Set("X-Tenant: acme"); err != nil {
+		t.Fatal(err)
+	}
+	src := &httpSource{URL: ts.URL, JSONPath: "{.count}", Headers: http.Header(headers), TokenFile: tokenFile.Name()}
+	if _, err := src.queueLength(""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHTTPSourceErrorStatus(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "<html>denied</html>", http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+
+	src := &httpSource{URL: ts.URL + "/backlog", JSONPath: "{.count}"}
+	_, err := src.queueLength("")
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+	if got, want := err.Error(), "401 Unauthorized"; !strings.HasSuffix(got, want) {
+		t.Errorf("Expected error ending with '%s', got: '%s'", want, got)
+	}
+}
+
+func TestHTTPSourceNotANumber(t *testing.T) {
+	src := &httpSource{JSONPath: "{.count}"}
+	if err := src.init(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := src.extract(map[string]interface{}{"count": []interface{}{}})
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+	if got, want := err.Error(), "JSONPath value of kind slice is not a number"; got != want {
+		t.Errorf("Expected error='%s', got: '%s'", want, got)
+	}
+}
+
+func TestHTTPSourceMissingJSONPath(t *testing.T) {
+	src := &httpSource{URL: "http://127.0.0.1"}
+	_, err := src.queueLength("")
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+	if got, want := err.Error(), "JSONPath expression must be defined"; got != want {
+		t.Errorf("Expected error='%s', got: '%s'", want, got)
+	}
+}
+
+func TestRelaxedJSONPath(t *testing.T) {
+	for expr, want := range map[string]string{
+		"{.a.b}": "{.a.b}",
+		".a.b":   "{.a.b}",
+		"a.b":    "{.a.b}",
+	} {
+		if got := relaxedJSONPath(expr); got != want {
+			t.Errorf("Expected '%s', got: '%s'", want, got)
+		}
+	}
+}
+
+func TestHeaderFlagsInvalid(t *testing.T) {
+	h := headerFlags{}
+	if err := h.Set("no-separator"); err == nil {
+		t.Fatal("Expected error")
+	}
+}
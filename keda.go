@@ -0,0 +1,159 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Trigger metadata of ScaledObjects using the autoscaler as KEDA external
+// scaler
+const (
+	// kedaQueue selects one of the queues, all queues summed when not set
+	kedaQueue = "queue"
+	// kedaThreshold is the queue length per replica, `threshold` when not set
+	kedaThreshold = "threshold"
+	// kedaActivation is the queue length above which the ScaledObject is
+	// active, 0 when not set
+	kedaActivation = "activationThreshold"
+)
+
+// kedaScaler serves statistics of the queues as KEDA external scaler, all
+// keeps samples of the queues summed and stores of each queue
+type kedaScaler struct {
+	clock       clock
+	all         SampleStore
+	stores      queueStores
+	duration    int
+	interval    int
+	coverage    float64
+	aggregation string
+	threshold   int
+}
+
+func (s *kedaScaler) IsActive(ctx context.Context, ref *scaledObjectRef) (*isActiveResponse, error) {
+	active, err := s.active(ref)
+	if err != nil {
+		return nil, err
+	}
+	return &isActiveResponse{Result: active}, nil
+}
+
+// StreamIsActive sends whether the ScaledObject is active when it changes,
+// checked every statistics interval
+func (s *kedaScaler) StreamIsActive(ref *scaledObjectRef, stream grpc.ServerStream) error {
+	sent := false
+	last := false
+	for {
+		if active, err := s.active(ref); err == nil && (!sent || active != last) {
+			if err := stream.SendMsg(&isActiveResponse{Result: active}); err != nil {
+				return err
+			}
+			sent, last = true, active
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-s.clock.After(time.Duration(s.interval) * time.Second):
+		}
+	}
+}
+
+func (s *kedaScaler) GetMetricSpec(ctx context.Context, ref *scaledObjectRef) (*getMetricSpecResponse, error) {
+	threshold, err := s.metadataInt(ref, kedaThreshold, s.threshold)
+	if err != nil {
+		return nil, err
+	}
+	if threshold < 1 {
+		return nil, status.Errorf(codes.InvalidArgument, "missing %s in scaler metadata", kedaThreshold)
+	}
+	return &getMetricSpecResponse{MetricSpecs: []*metricSpec{{MetricName: externalQueueLength, TargetSize: int64(threshold)}}}, nil
+}
+
+func (s *kedaScaler) GetMetrics(ctx context.Context, req *getMetricsRequest) (*getMetricsResponse, error) {
+	length, err := s.queueLength(req.ScaledObjectRef)
+	if err != nil {
+		return nil, err
+	}
+	name := req.MetricName
+	if len(name) == 0 {
+		name = externalQueueLength
+	}
+	return &getMetricsResponse{MetricValues: []*metricValue{{MetricName: name, MetricValue: int64(math.Ceil(length))}}}, nil
+}
+
+// active reports whether queue length of the ScaledObject is above its
+// activation threshold
+func (s *kedaScaler) active(ref *scaledObjectRef) (bool, error) {
+	activation, err := s.metadataInt(ref, kedaActivation, 0)
+	if err != nil {
+		return false, err
+	}
+	length, err := s.queueLength(ref)
+	if err != nil {
+		return false, err
+	}
+	return length > float64(activation), nil
+}
+
+// queueLength returns aggregated length of the queue selected by the
+// ScaledObject, fails without enough samples in the window
+func (s *kedaScaler) queueLength(ref *scaledObjectRef) (float64, error) {
+	store := s.all
+	if ref != nil {
+		if queue := ref.ScalerMetadata[kedaQueue]; len(queue) > 0 {
+			store = nil
+			for _, qs := range s.stores {
+				if qs.Queue == queue {
+					store = qs.Store
+				}
+			}
+			if store == nil {
+				return 0, status.Errorf(codes.NotFound, "queue '%s' is not sampled", queue)
+			}
+		}
+	}
+	stats, err := store.Stats(s.duration, s.interval)
+	if err != nil {
+		return 0, status.Error(codes.Internal, err.Error())
+	}
+	if stats.Coverage < s.coverage {
+		return 0, status.Errorf(codes.Unavailable, "not enough metrics, required at least %.2f was %.2f metrics ratio", s.coverage, stats.Coverage)
+	}
+	return stats.aggregate(s.aggregation), nil
+}
+
+// metadataInt returns integer value of the scaler metadata key, def when
+// not set
+func (s *kedaScaler) metadataInt(ref *scaledObjectRef, key string, def int) (int, error) {
+	if ref == nil || len(ref.ScalerMetadata[key]) == 0 {
+		return def, nil
+	}
+	n, err := strconv.Atoi(ref.ScalerMetadata[key])
+	if err != nil {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid %s '%s' in scaler metadata", key, ref.ScalerMetadata[key])
+	}
+	return n, nil
+}
+
+// serveKEDA serves the scaler as KEDA external scaler gRPC service
+func serveKEDA(addr string, scaler externalScalerServer) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := grpc.NewServer()
+	server.RegisterService(&externalScalerService, scaler)
+	return server.Serve(lis)
+}
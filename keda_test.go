@@ -0,0 +1,172 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestKEDA samples 10 messages on queue `tasks` and 2 on `events` for
+// the whole window
+func newTestKEDA() *kedaScaler {
+	clk := newFakeClock(time.Unix(1500000000, 0))
+	all := newMemoryStore(clk, 20, 5)
+	stores := queueStores{{Queue: "tasks", Store: newMemoryStore(clk, 20, 5)},
+		{Queue: "events", Store: newMemoryStore(clk, 20, 5)}}
+	fpoll := stores.poll(clk, func(names []string) []queueSample {
+		return []queueSample{{Name: "tasks", Messages: 10}, {Name: "events", Messages: 2}}
+	})
+	for i := 0; i < 4; i++ {
+		fpoll(nil)
+		all.Add(12, unknownAge)
+		clk.Advance(5 * time.Second)
+	}
+	return &kedaScaler{clock: clk, all: all, stores: stores, duration: 20, interval: 5, coverage: 0.75, aggregation: aggAverage, threshold: 5}
+}
+
+// dialKEDA serves scaler on an in-memory listener
+func dialKEDA(t *testing.T, scaler externalScalerServer) *grpc.ClientConn {
+	lis := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	server.RegisterService(&externalScalerService, scaler)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(),
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestKEDAGetMetrics(t *testing.T) {
+	conn := dialKEDA(t, newTestKEDA())
+	ctx := context.Background()
+
+	var spec getMetricSpecResponse
+	if err := conn.Invoke(ctx, "/externalscaler.ExternalScaler/GetMetricSpec",
+		&scaledObjectRef{ScalerMetadata: map[string]string{kedaThreshold: "4"}}, &spec); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(spec.MetricSpecs), 1; got != want {
+		t.Fatalf("Expected %d metric specs, got: %d", want, got)
+	}
+	if got, want := spec.MetricSpecs[0].TargetSize, int64(4); got != want {
+		t.Errorf("Expected target size=%d, got: %d", want, got)
+	}
+
+	tests := []struct {
+		queue string
+		want  int64
+	}{{"", 12}, {"tasks", 10}, {"events", 2}}
+	for _, tt := range tests {
+		var metrics getMetricsResponse
+		req := &getMetricsRequest{ScaledObjectRef: &scaledObjectRef{ScalerMetadata: map[string]string{kedaQueue: tt.queue}}, MetricName: "s0-queue-length"}
+		if err := conn.Invoke(ctx, "/externalscaler.ExternalScaler/GetMetrics", req, &metrics); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := metrics.MetricValues[0].MetricValue, tt.want; got != want {
+			t.Errorf("Expected value=%d of queue '%s', got: %d", want, tt.queue, got)
+		}
+		if got, want := metrics.MetricValues[0].MetricName, "s0-queue-length"; got != want {
+			t.Errorf("Expected metric name='%s', got: '%s'", want, got)
+		}
+	}
+
+	err := conn.Invoke(ctx, "/externalscaler.ExternalScaler/GetMetrics",
+		&getMetricsRequest{ScaledObjectRef: &scaledObjectRef{ScalerMetadata: map[string]string{kedaQueue: "other"}}}, &getMetricsResponse{})
+	if got, want := status.Code(err), codes.NotFound; got != want {
+		t.Errorf("Expected code %v, got: %v", want, got)
+	}
+}
+
+func TestKEDAIsActive(t *testing.T) {
+	scaler := newTestKEDA()
+	conn := dialKEDA(t, scaler)
+	ctx := context.Background()
+
+	tests := []struct {
+		activation string
+		want       bool
+	}{{"", true}, {"11", true}, {"12", false}}
+	for _, tt := range tests {
+		var resp isActiveResponse
+		if err := conn.Invoke(ctx, "/externalscaler.ExternalScaler/IsActive",
+			&scaledObjectRef{ScalerMetadata: map[string]string{kedaActivation: tt.activation}}, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := resp.Result, tt.want; got != want {
+			t.Errorf("Expected active=%v with activation threshold '%s', got: %v", want, tt.activation, got)
+		}
+	}
+
+	err := conn.Invoke(ctx, "/externalscaler.ExternalScaler/IsActive",
+		&scaledObjectRef{ScalerMetadata: map[string]string{kedaActivation: "x"}}, &isActiveResponse{})
+	if got, want := status.Code(err), codes.InvalidArgument; got != want {
+		t.Errorf("Expected code %v, got: %v", want, got)
+	}
+
+	scaler.coverage = 2
+	err = conn.Invoke(ctx, "/externalscaler.ExternalScaler/IsActive", &scaledObjectRef{}, &isActiveResponse{})
+	if got, want := status.Code(err), codes.Unavailable; got != want {
+		t.Errorf("Expected code %v, got: %v", want, got)
+	}
+}
+
+func TestKEDAStreamIsActive(t *testing.T) {
+	conn := dialKEDA(t, newTestKEDA())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := conn.NewStream(ctx, &externalScalerService.Streams[0], "/externalscaler.ExternalScaler/StreamIsActive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.SendMsg(&scaledObjectRef{ScalerMetadata: map[string]string{kedaQueue: "tasks"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	var resp isActiveResponse
+	if err := stream.RecvMsg(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Result {
+		t.Error("Expected active")
+	}
+}
+
+func TestExternalScalerWireFormat(t *testing.T) {
+	b, err := proto.Marshal(&metricSpec{MetricName: "q", TargetSize: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0x0a, 1, 'q', 0x10, 5}; !bytes.Equal(b, want) {
+		t.Errorf("Expected %x, got: %x", want, b)
+	}
+
+	var ref scaledObjectRef
+	if err := proto.Unmarshal([]byte{0x12, 4, 'j', 'o', 'b', 's', 0x1a, 7, 0x0a, 1, 'k', 0x12, 2, 'v', 'v'}, &ref); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ref.Namespace, "jobs"; got != want {
+		t.Errorf("Expected namespace='%s', got: '%s'", want, got)
+	}
+	if got, want := ref.ScalerMetadata["k"], "vv"; got != want {
+		t.Errorf("Expected metadata k='%s', got: '%s'", want, got)
+	}
+}
@@ -6,22 +6,49 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"time"
 
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	appslisters "k8s.io/client-go/listers/apps/v1"
 	restclient "k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 	certutil "k8s.io/client-go/util/cert"
+	"k8s.io/client-go/util/retry"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"k8s.io/client-go/kubernetes"
+	// OIDC authentication provider of kubeconfig users
+	_ "k8s.io/client-go/plugin/pkg/client/auth/oidc"
 )
 
 const (
 	deploymentKind            = "Deployment"
 	replicationControllerKind = "ReplicationController"
 	replicaSetKind            = "ReplicaSet"
+
+	// eventComponent is the source of Kubernetes events recorded by the autoscaler
+	eventComponent = "kube-amqp-autoscale"
+	// fieldManager owns `spec.replicas` of the autoscaled resource, the API
+	// server takes the manager name from the user agent
+	fieldManager = "kube-amqp-autoscale"
+
+	// Reasons of the events recorded on the scaled resource
+	reasonSuccessfulRescale = "SuccessfulRescale"
+	reasonFailedRescale     = "FailedRescale"
+	reasonScalingLimited    = "ScalingLimited"
+	reasonScalingHeld       = "ScalingHeld"
+
+	// heldStarting is the reason of holding scaling up while replicas
+	// are starting
+	heldStarting = "replicas-starting"
 )
 
 var (
@@ -33,85 +60,380 @@ var (
 		},
 		[]string{"kind", "name"},
 	)
+	startingReplicas = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "starting_replicas",
+			Help:      "Number of replicas of the autoscaled resource not ready yet.",
+		},
+	)
 )
 
+// apiContext holds Kubernetes API connection, URL with User, Passwd or
+// TokenFile is used when set, otherwise the in-cluster service account or
+// Kubeconfig file with its Context
 type apiContext struct {
-	URL       string
-	User      string
-	Passwd    string
-	TokenFile string
-	CAFile    string
-	Insecure  bool
-	Bounds    *scaleBounds
+	URL        string
+	User       string
+	Passwd     string
+	TokenFile  string
+	CAFile     string
+	Insecure   bool
+	Kubeconfig string
+	Context    string
 
 	clientConf *restclient.Config
 }
 
-func scale(kind string, ns string, name string, newSize int32, ctx *apiContext) error {
-	c, err := ctx.client()
-	if err != nil {
-		return err
-	}
-	return scaleKind(c, kind, ns, name, newSize, ctx.Bounds)
+// kubeTarget is the autoscaled Kubernetes resource, watched by a shared
+// informer so scaling reads it from the cache instead of the API
+type kubeTarget struct {
+	Kind      string
+	Namespace string
+	Name      string
+	Bounds    *scaleBounds
+	// RolloutHold is the scaling held while a rollout of a deployment
+	// is in progress
+	RolloutHold string
+	// StartupGrace is the time after scaling up during which replicas not
+	// ready yet hold further scaling up, 0 disables
+	StartupGrace time.Duration
+	// CapacityCheck holds scaling up while pods can't be scheduled or
+	// the resource quotas are used up
+	CapacityCheck bool
+	// Clock is the system clock when not set
+	Clock clock
+
+	client      kubernetes.Interface
+	factory     informers.SharedInformerFactory
+	deployments appslisters.DeploymentLister
+	replicaSets appslisters.ReplicaSetLister
+
+	// bound which limited and rollout which held the last decision
+	bound string
+	held  string
+	// scaledUp is the time of the last increase of the replicas
+	scaledUp time.Time
+	// recorded is the time of the last recorded event
+	recorded time.Time
 }
 
-func scaleKind(c *kubernetes.Clientset, kind string, ns string, name string, newSize int32, b *scaleBounds) error {
+func newKubeTarget(c kubernetes.Interface, kind string, ns string, name string, b *scaleBounds) (*kubeTarget, error) {
+	factory := informers.NewSharedInformerFactoryWithOptions(c, 0,
+		informers.WithNamespace(ns),
+		informers.WithTweakListOptions(func(opts *v1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}))
+	t := &kubeTarget{Kind: kind, Namespace: ns, Name: name, Bounds: b, client: c, factory: factory}
 	switch kind {
 	case replicaSetKind:
-		return scaleReplicaSets(c, ns, name, newSize, b)
+		t.replicaSets = factory.Apps().V1().ReplicaSets().Lister()
+	case deploymentKind:
+		t.deployments = factory.Apps().V1().Deployments().Lister()
+	default:
+		return nil, fmt.Errorf("No scaler has been implemented for '%s'", kind)
+	}
+	return t, nil
+}
+
+// start watches the target until quit is closed, returns when the cache
+// is synced
+func (t *kubeTarget) start(quit <-chan struct{}) error {
+	t.factory.Start(quit)
+	for typ, synced := range t.factory.WaitForCacheSync(quit) {
+		if !synced {
+			return fmt.Errorf("Failed to sync cache of %v", typ)
+		}
+	}
+	return nil
+}
+
+func (t *kubeTarget) scale(d *scaleDecision) error {
+	var obj *v1.ObjectMeta
+	var err error
+	switch t.Kind {
+	case replicaSetKind:
+		obj, err = t.scaleReplicaSet(d)
 	case deploymentKind:
-		return scaleDeployments(c, ns, name, newSize, b)
+		obj, err = t.scaleDeployment(d)
+	default:
+		return fmt.Errorf("No scaler has been implemented for '%s'", t.Kind)
 	}
-	return fmt.Errorf("No scaler has been implemented for '%s'", kind)
+	if obj != nil {
+		for _, e := range t.events(d, err) {
+			recordEvent(t.client, t.Kind, obj, e, t.eventTime())
+		}
+	}
+	return err
 }
 
-func scaleDeployments(c *kubernetes.Clientset, ns string, name string, newSize int32, b *scaleBounds) error {
-	deployment, err := c.AppsV1().Deployments(ns).Get(name, v1.GetOptions{})
+// events returns Kubernetes events of the decision applied with err,
+// ScalingLimited and ScalingHeld are returned when the limiting bound or
+// the rollout holding scaling changes
+func (t *kubeTarget) events(d *scaleDecision, err error) []*scaleEvent {
+	var events []*scaleEvent
+	if d.Event != nil {
+		events = append(events, d.Event)
+	}
+	if len(d.Held) > 0 && d.Held != t.held {
+		msg := fmt.Sprintf("Holding rescale from %d to %d replicas until the rollout completes, rollout %s", d.Current, d.Desired, d.Held)
+		switch d.Held {
+		case heldStarting:
+			msg = fmt.Sprintf("Holding rescale from %d to %d replicas until %d starting replicas are ready", d.Current, d.Desired, d.Current-d.Ready)
+		case heldUnschedulable:
+			msg = fmt.Sprintf("Holding rescale from %d to %d replicas until pending pods can be scheduled", d.Current, d.Desired)
+		case heldQuota:
+			msg = fmt.Sprintf("Holding rescale from %d to %d replicas until resource quota is available", d.Current, d.Desired)
+		}
+		events = append(events, &scaleEvent{Type: corev1.EventTypeNormal, Reason: reasonScalingHeld, Message: msg})
+	}
+	t.held = d.Held
+	if len(d.Bound) > 0 && d.Bound != t.bound {
+		events = append(events, &scaleEvent{Type: corev1.EventTypeNormal,
+			Reason:  reasonScalingLimited,
+			Message: fmt.Sprintf("Desired size %d limited to %d replicas by %s bound", d.Desired, d.Scaled, d.Bound)})
+	}
+	t.bound = d.Bound
+	if d.Scaled == d.Current {
+		return events
+	}
 	if err != nil {
-		return err
+		return append(events, &scaleEvent{Type: corev1.EventTypeWarning,
+			Reason:  reasonFailedRescale,
+			Message: fmt.Sprintf("Failed to rescale from %d to %d replicas: %v; reason: %s", d.Current, d.Scaled, err, d.reason())})
 	}
-	replicas := b.newSize(*deployment.Spec.Replicas, newSize)
-	if replicas != *deployment.Spec.Replicas {
-		log.Printf("Scaling deployment '%s' from %d to %d replicas", name, *deployment.Spec.Replicas, replicas)
-		scalingEvents.With(prometheus.Labels{"kind": "Deployment", "name": name}).Inc()
-		deployment.Spec.Replicas = &replicas
-		_, err = c.AppsV1().Deployments(ns).Update(deployment)
-		if err != nil {
-			return err
+	return append(events, &scaleEvent{Type: corev1.EventTypeNormal,
+		Reason:  reasonSuccessfulRescale,
+		Message: fmt.Sprintf("New size: %d; old size: %d; reason: %s", d.Scaled, d.Current, d.reason())})
+}
+
+// scaleDeployment updates replicas of the deployment, returns its metadata
+// once it was found in the cache
+func (t *kubeTarget) scaleDeployment(d *scaleDecision) (*v1.ObjectMeta, error) {
+	deployment, err := t.deployments.Deployments(t.Namespace).Get(t.Name)
+	if err != nil {
+		return nil, err
+	}
+	replicas := t.Bounds.resize(d, *deployment.Spec.Replicas)
+	if holds(t.RolloutHold, *deployment.Spec.Replicas, replicas) {
+		if status := rolloutStatus(deployment); len(status) > 0 {
+			log.Printf("Holding deployment '%s' at %d replicas instead of %d, rollout %s", t.Name, *deployment.Spec.Replicas, replicas, status)
+			d.hold(status)
 		}
 	}
-	return nil
+	setRolloutHold(d.Held)
+	t.holdStarting(d, deployment.Status.ReadyReplicas)
+	t.checkCapacity(d, deployment.Spec.Selector, &deployment.Spec.Template)
+	if replicas = d.Scaled; replicas != *deployment.Spec.Replicas {
+		log.Printf("Scaling deployment '%s' from %d to %d replicas", t.Name, *deployment.Spec.Replicas, replicas)
+		scalingEvents.With(prometheus.Labels{"kind": "Deployment", "name": t.Name}).Inc()
+		deployments := t.client.AppsV1().Deployments(t.Namespace)
+		err = t.update(d, &deployment.ObjectMeta,
+			func() (*autoscalingv1.Scale, error) { return deployments.GetScale(t.Name, v1.GetOptions{}) },
+			func(s *autoscalingv1.Scale) (*autoscalingv1.Scale, error) { return deployments.UpdateScale(t.Name, s) })
+	}
+	return &deployment.ObjectMeta, err
 }
 
-func scaleReplicaSets(c *kubernetes.Clientset, ns string, name string, newSize int32, b *scaleBounds) error {
-	pod, err := c.AppsV1().ReplicaSets(ns).Get(name, v1.GetOptions{})
+// scaleReplicaSet updates replicas of the replica set, returns its
+// metadata once it was found in the cache
+func (t *kubeTarget) scaleReplicaSet(d *scaleDecision) (*v1.ObjectMeta, error) {
+	pod, err := t.replicaSets.ReplicaSets(t.Namespace).Get(t.Name)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	replicas := b.newSize(*pod.Spec.Replicas, newSize)
-	if replicas != *pod.Spec.Replicas {
-		log.Printf("Scaling replica set '%s' from %d to %d replicas", name, *pod.Spec.Replicas, replicas)
-		scalingEvents.With(prometheus.Labels{"kind": "ReplicaSet", "name": name}).Inc()
-		pod.Spec.Replicas = &replicas
-		_, err = c.AppsV1().ReplicaSets(ns).Update(pod)
-		if err != nil {
-			return err
+	t.Bounds.resize(d, *pod.Spec.Replicas)
+	t.holdStarting(d, pod.Status.ReadyReplicas)
+	t.checkCapacity(d, pod.Spec.Selector, &pod.Spec.Template)
+	if replicas := d.Scaled; replicas != *pod.Spec.Replicas {
+		log.Printf("Scaling replica set '%s' from %d to %d replicas", t.Name, *pod.Spec.Replicas, replicas)
+		scalingEvents.With(prometheus.Labels{"kind": "ReplicaSet", "name": t.Name}).Inc()
+		replicaSets := t.client.AppsV1().ReplicaSets(t.Namespace)
+		err = t.update(d, &pod.ObjectMeta,
+			func() (*autoscalingv1.Scale, error) { return replicaSets.GetScale(t.Name, v1.GetOptions{}) },
+			func(s *autoscalingv1.Scale) (*autoscalingv1.Scale, error) { return replicaSets.UpdateScale(t.Name, s) })
+	}
+	return &pod.ObjectMeta, err
+}
+
+// holdStarting counts replicas added by the last scale up which are not
+// ready within the startup grace period as capacity about to consume the
+// messages queued meanwhile, scaling up is held unless more replicas than
+// the starting ones are desired
+func (t *kubeTarget) holdStarting(d *scaleDecision, ready int32) {
+	d.Ready = ready
+	starting := max(d.Current-ready, 0)
+	startingReplicas.Set(float64(starting))
+	if t.StartupGrace <= 0 || len(d.Held) > 0 || d.Scaled <= d.Current || starting == 0 {
+		return
+	}
+	since := t.now().Sub(t.scaledUp)
+	if since >= t.StartupGrace {
+		return
+	}
+	if desired := d.Desired - starting; desired > d.Current {
+		log.Printf("Scaling %s '%s' to %d replicas counting %d replicas starting for %v", t.Kind, t.Name, desired, starting, since.Round(time.Second))
+		d.Scaled, d.Bound = t.Bounds.limit(d.Current, desired)
+		return
+	}
+	log.Printf("Holding %s '%s' at %d replicas instead of %d, %d replicas starting for %v", t.Kind, t.Name, d.Current, d.Scaled, starting, since.Round(time.Second))
+	d.hold(heldStarting)
+}
+
+// update sets the scaled replicas of the resource through the scale
+// subresource; when the replicas were changed by someone else since the
+// decision was made nothing is scaled until the next interval decides on
+// the new replicas
+func (t *kubeTarget) update(d *scaleDecision, obj *v1.ObjectMeta,
+	get func() (*autoscalingv1.Scale, error),
+	update func(*autoscalingv1.Scale) (*autoscalingv1.Scale, error)) error {
+	latest, err := updateScale(obj, d.Current, d.Scaled, get, update)
+	if err == errReplicasChanged {
+		log.Printf("Replicas of %s '%s' changed from %d to %d meanwhile, not scaling to %d", t.Kind, t.Name, d.Current, latest, d.Scaled)
+		d.Current, d.Scaled = latest, latest
+		return nil
+	}
+	t.scaled(d, err)
+	return err
+}
+
+// scaled remembers when the replicas were increased successfully
+func (t *kubeTarget) scaled(d *scaleDecision, err error) {
+	if err == nil && d.Scaled > d.Current {
+		t.scaledUp = t.now()
+	}
+}
+
+// eventTime returns the time of the next event, a nanosecond after the last
+// one when the clock hasn't moved since, so names of the events are unique
+func (t *kubeTarget) eventTime() time.Time {
+	now := t.now()
+	if !now.After(t.recorded) {
+		now = t.recorded.Add(time.Nanosecond)
+	}
+	t.recorded = now
+	return now
+}
+
+func (t *kubeTarget) now() time.Time {
+	if t.Clock == nil {
+		return time.Now()
+	}
+	return t.Clock.Now()
+}
+
+// errReplicasChanged is returned by updateScale when replicas of the
+// resource were changed by someone else after the scale was decided
+var errReplicasChanged = errors.New("replicas changed concurrently")
+
+// updateScale sets replicas of the resource with its scale subresource,
+// which changes `spec.replicas` only. The first update is made with the
+// resource version of the cached obj, on conflicts the scale is read again
+// and the update retried unless its replicas are no longer current; the
+// replicas read last are returned
+func updateScale(obj *v1.ObjectMeta, current, replicas int32,
+	get func() (*autoscalingv1.Scale, error),
+	update func(*autoscalingv1.Scale) (*autoscalingv1.Scale, error)) (int32, error) {
+	scale := &autoscalingv1.Scale{
+		ObjectMeta: v1.ObjectMeta{Name: obj.Name, Namespace: obj.Namespace, ResourceVersion: obj.ResourceVersion},
+	}
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if scale == nil {
+			latest, err := get()
+			if err != nil {
+				return err
+			}
+			if latest.Spec.Replicas != current {
+				current = latest.Spec.Replicas
+				return errReplicasChanged
+			}
+			scale = latest
 		}
+		scale.Spec.Replicas = replicas
+		_, err := update(scale)
+		scale = nil
+		return err
+	})
+	return current, err
+}
+
+// recordEvent creates Kubernetes event on the scaled resource at time ts,
+// failures are logged only
+func recordEvent(c kubernetes.Interface, kind string, obj *v1.ObjectMeta, e *scaleEvent, ts time.Time) {
+	if e == nil {
+		return
+	}
+	now := v1.NewTime(ts)
+	event := &corev1.Event{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", obj.Name, now.UnixNano()),
+			Namespace: obj.Namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			Kind:            kind,
+			APIVersion:      "apps/v1",
+			Namespace:       obj.Namespace,
+			Name:            obj.Name,
+			UID:             obj.UID,
+			ResourceVersion: obj.ResourceVersion,
+		},
+		Type:           e.Type,
+		Reason:         e.Reason,
+		Message:        e.Message,
+		Source:         corev1.EventSource{Component: eventComponent},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	if _, err := c.CoreV1().Events(obj.Namespace).Create(event); err != nil {
+		log.Printf("Failed to record %s event on %s '%s': %v", e.Reason, kind, obj.Name, err)
 	}
-	return nil
 }
 
 func (ctx *apiContext) client() (*kubernetes.Clientset, error) {
 	if ctx.clientConf == nil {
-		conf, err := apiConfig(ctx.URL, ctx.User, ctx.Passwd, ctx.TokenFile, ctx.CAFile, ctx.Insecure)
+		conf, err := ctx.config()
 		if err != nil {
 			return nil, err
 		}
+		conf.UserAgent = fieldManager
 		ctx.clientConf = conf
 	}
 	return kubernetes.NewForConfig(ctx.clientConf)
 }
 
+func (ctx *apiContext) config() (*restclient.Config, error) {
+	if len(ctx.URL) > 0 {
+		return apiConfig(ctx.URL, ctx.User, ctx.Passwd, ctx.TokenFile, ctx.CAFile, ctx.Insecure)
+	}
+	if len(ctx.Kubeconfig) == 0 && len(ctx.Context) == 0 {
+		conf, err := restclient.InClusterConfig()
+		if err == nil {
+			log.Print("Using in-cluster Kubernetes API configuration")
+			return conf, nil
+		}
+		if err != restclient.ErrNotInCluster {
+			return nil, err
+		}
+	}
+	return kubeconfig(ctx.Kubeconfig, ctx.Context)
+}
+
+// kubeconfig loads Kubernetes API configuration of context, the current
+// context when empty, from file or from `KUBECONFIG` environment variable
+// and the default location when file is empty
+func kubeconfig(file string, context string) (*restclient.Config, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = file
+	conf, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules,
+		&clientcmd.ConfigOverrides{CurrentContext: context}).ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Using Kubernetes API configuration from kubeconfig, server %s", conf.Host)
+	return conf, nil
+}
+
 func apiConfig(apiURL string,
 	apiUser string,
 	apiPasswd string,
@@ -141,7 +463,9 @@ func apiConfig(apiURL string,
 		if err != nil {
 			return nil, err
 		}
+		// the file is re-read periodically for rotated tokens
 		cfg.BearerToken = string(token)
+		cfg.BearerTokenFile = apiTokenFile
 	}
 
 	if len(apiCAFile) > 0 {
@@ -164,24 +488,52 @@ type scaleBounds struct {
 	DecreaseLimit int
 }
 
+// Names of the scale bounds limiting the number of replicas
+const (
+	boundMin           = "min"
+	boundMax           = "max"
+	boundIncreaseLimit = "increase-limit"
+	boundDecreaseLimit = "decrease-limit"
+)
+
 func (sb *scaleBounds) newSize(size, newSize int32) int32 {
+	replicas, _ := sb.limit(size, newSize)
+	return replicas
+}
+
+// limit returns newSize within the bounds and name of the bound which
+// changed it, empty when newSize is within the bounds
+func (sb *scaleBounds) limit(size, newSize int32) (int32, string) {
 	if size == newSize {
-		return newSize
+		return newSize, ""
 	}
 	replicas := newSize
+	bound := ""
 	if newSize < size {
-		if sb.DecreaseLimit > 0 {
-			replicas = max(size-int32(sb.DecreaseLimit), newSize)
+		if sb.DecreaseLimit > 0 && size-int32(sb.DecreaseLimit) > newSize {
+			replicas, bound = size-int32(sb.DecreaseLimit), boundDecreaseLimit
 		}
 	} else {
-		if sb.IncreaseLimit > 0 {
-			replicas = min(size+int32(sb.IncreaseLimit), newSize)
+		if sb.IncreaseLimit > 0 && size+int32(sb.IncreaseLimit) < newSize {
+			replicas, bound = size+int32(sb.IncreaseLimit), boundIncreaseLimit
 		}
 	}
-	replicas = max(replicas, int32(sb.Min))
-	replicas = min(replicas, int32(sb.Max))
+	if replicas < int32(sb.Min) {
+		replicas, bound = int32(sb.Min), boundMin
+	}
+	if replicas > int32(sb.Max) {
+		replicas, bound = int32(sb.Max), boundMax
+	}
+	return replicas, bound
+}
 
-	return replicas
+// resize returns number of replicas for a resource running current
+// replicas and fills the sizes of the decision
+func (sb *scaleBounds) resize(d *scaleDecision, current int32) int32 {
+	d.Current = current
+	d.Desired = d.size(current)
+	d.Scaled, d.Bound = sb.limit(current, d.Desired)
+	return d.Scaled
 }
 
 func min(x, y int32) int32 {
@@ -5,20 +5,311 @@
 
 package main
 
-import "testing"
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
 
-func TestScaleInvalidKind(t *testing.T) {
-	if got, want := scale("X", "", "", 0, &apiContext{URL: "http://127.0.0.1:8080"}).Error(), "No scaler has been implemented for 'X'"; got != want {
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestNewKubeTargetInvalidKind(t *testing.T) {
+	_, err := newKubeTarget(fake.NewSimpleClientset(), "X", "", "", nil)
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+	if got, want := err.Error(), "No scaler has been implemented for 'X'"; got != want {
 		t.Errorf("Expected error='%s', got: '%s'", want, got)
 	}
 }
 
-func TestScaleKindInvalidKind(t *testing.T) {
-	if got, want := scaleKind(nil, "X", "", "", 0, nil).Error(), "No scaler has been implemented for 'X'"; got != want {
+func TestScaleInvalidKind(t *testing.T) {
+	if got, want := (&kubeTarget{Kind: "X"}).scale(&scaleDecision{}).Error(), "No scaler has been implemented for 'X'"; got != want {
 		t.Errorf("Expected error='%s', got: '%s'", want, got)
 	}
 }
 
+// newScaleClientset returns fake clientset serving the scale subresource
+// of its deployments and replica sets
+func newScaleClientset(objects ...runtime.Object) *fake.Clientset {
+	c := fake.NewSimpleClientset(objects...)
+	c.PrependReactor("*", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+		var name string
+		var replicas *int32
+		switch a := action.(type) {
+		case k8stesting.GetAction:
+			name = a.GetName()
+		case k8stesting.UpdateAction:
+			scale := a.GetObject().(*autoscalingv1.Scale)
+			name, replicas = scale.Name, &scale.Spec.Replicas
+		default:
+			return false, nil, nil
+		}
+		obj, err := c.Tracker().Get(action.GetResource(), action.GetNamespace(), name)
+		if err != nil {
+			return true, nil, err
+		}
+		var current int32
+		switch o := obj.(type) {
+		case *appsv1.Deployment:
+			if replicas != nil {
+				o.Spec.Replicas = replicas
+			}
+			current = *o.Spec.Replicas
+		case *appsv1.ReplicaSet:
+			if replicas != nil {
+				o.Spec.Replicas = replicas
+			}
+			current = *o.Spec.Replicas
+		}
+		if replicas != nil {
+			if err := c.Tracker().Update(action.GetResource(), obj, action.GetNamespace()); err != nil {
+				return true, nil, err
+			}
+		}
+		return true, &autoscalingv1.Scale{ObjectMeta: v1.ObjectMeta{Name: name, Namespace: action.GetNamespace()},
+			Spec: autoscalingv1.ScaleSpec{Replicas: current}}, nil
+	})
+	return c
+}
+
+func startTestTarget(t *testing.T, c *fake.Clientset, kind string) *kubeTarget {
+	target, err := newKubeTarget(c, kind, "jobs", "worker", &scaleBounds{Min: 1, Max: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	quit := make(chan struct{})
+	t.Cleanup(func() { close(quit) })
+	if err := target.start(quit); err != nil {
+		t.Fatal(err)
+	}
+	return target
+}
+
+// updates returns number of update requests made with the client
+func updates(c *fake.Clientset) int {
+	n := 0
+	for _, action := range c.Actions() {
+		if action.GetVerb() == "update" {
+			n++
+		}
+	}
+	return n
+}
+
+func TestKubeTargetScaleDeployment(t *testing.T) {
+	replicas := int32(2)
+	c := newScaleClientset(&appsv1.Deployment{
+		ObjectMeta: v1.ObjectMeta{Name: "worker", Namespace: "jobs"},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+	})
+	target := startTestTarget(t, c, deploymentKind)
+
+	if err := target.scale(&scaleDecision{Replicas: 2, OldestAge: unknownAge}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := updates(c), 0; got != want {
+		t.Errorf("Expected %d updates without change of replicas, got: %d", want, got)
+	}
+
+	if err := target.scale(&scaleDecision{Replicas: 5, OldestAge: unknownAge}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := updates(c), 1; got != want {
+		t.Errorf("Expected %d updates, got: %d", want, got)
+	}
+	deployment, err := c.AppsV1().Deployments("jobs").Get("worker", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := *deployment.Spec.Replicas, int32(5); got != want {
+		t.Errorf("Expected replicas=%d, got: %d", want, got)
+	}
+}
+
+func TestKubeTargetScaleReplicaSet(t *testing.T) {
+	replicas := int32(4)
+	c := newScaleClientset(&appsv1.ReplicaSet{
+		ObjectMeta: v1.ObjectMeta{Name: "worker", Namespace: "jobs"},
+		Spec:       appsv1.ReplicaSetSpec{Replicas: &replicas},
+	})
+	target := startTestTarget(t, c, replicaSetKind)
+
+	if err := target.scale(&scaleDecision{Replicas: 20, OldestAge: unknownAge}); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := c.AppsV1().ReplicaSets("jobs").Get("worker", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := *rs.Spec.Replicas, int32(10); got != want {
+		t.Errorf("Expected replicas=%d, got: %d", want, got)
+	}
+}
+
+// eventReasons returns reasons of the events recorded in namespace jobs
+func eventReasons(t *testing.T, c *fake.Clientset) []string {
+	events, err := c.CoreV1().Events("jobs").List(v1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reasons []string
+	for _, e := range events.Items {
+		reasons = append(reasons, e.Reason)
+	}
+	sort.Strings(reasons)
+	return reasons
+}
+
+func TestKubeTargetRescaleEvents(t *testing.T) {
+	replicas := int32(4)
+	c := newScaleClientset(&appsv1.ReplicaSet{
+		ObjectMeta: v1.ObjectMeta{Name: "worker", Namespace: "jobs"},
+		Spec:       appsv1.ReplicaSetSpec{Replicas: &replicas},
+	})
+	target := startTestTarget(t, c, replicaSetKind)
+
+	if err := target.scale(&scaleDecision{Replicas: 20, OldestAge: unknownAge, Reason: "queue length avg 200.00, threshold 10"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(eventReasons(t, c), ","), "ScalingLimited,SuccessfulRescale"; got != want {
+		t.Errorf("Expected events '%s', got: '%s'", want, got)
+	}
+
+	c.PrependReactor("update", "replicasets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("conflict")
+	})
+	if err := target.scale(&scaleDecision{Replicas: 2, OldestAge: unknownAge}); err == nil {
+		t.Fatal("Expected error")
+	}
+	if got, want := strings.Join(eventReasons(t, c), ","), "FailedRescale,ScalingLimited,SuccessfulRescale"; got != want {
+		t.Errorf("Expected events '%s', got: '%s'", want, got)
+	}
+}
+
+func TestKubeTargetEvents(t *testing.T) {
+	target := &kubeTarget{}
+	d := &scaleDecision{Replicas: 12, Reason: "queue length avg 120.00, threshold 10", Current: 4, Desired: 12, Scaled: 10, Bound: boundMax}
+	events := target.events(d, nil)
+	if got, want := len(events), 2; got != want {
+		t.Fatalf("Expected %d events, got: %d", want, got)
+	}
+	if got, want := events[0].Message, "Desired size 12 limited to 10 replicas by max bound"; got != want {
+		t.Errorf("Expected message='%s', got: '%s'", want, got)
+	}
+	if got, want := events[1].Message, "New size: 10; old size: 4; reason: queue length avg 120.00, threshold 10, desired 12 replicas limited by max bound"; got != want {
+		t.Errorf("Expected message='%s', got: '%s'", want, got)
+	}
+
+	// limited by the same bound without change of replicas
+	d = &scaleDecision{Replicas: 12, Current: 10, Desired: 12, Scaled: 10, Bound: boundMax}
+	if events := target.events(d, nil); len(events) != 0 {
+		t.Errorf("Expected no events, got: %+v", events)
+	}
+}
+
+func TestKubeTargetScaleConflict(t *testing.T) {
+	replicas := int32(2)
+	c := newScaleClientset(&appsv1.Deployment{
+		ObjectMeta: v1.ObjectMeta{Name: "worker", Namespace: "jobs", ResourceVersion: "1"},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+	})
+	target := startTestTarget(t, c, deploymentKind)
+
+	conflicts := 0
+	c.PrependReactor("update", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		scale := action.(k8stesting.UpdateAction).GetObject().(*autoscalingv1.Scale)
+		// the cached resource version is stale
+		if scale.ResourceVersion == "1" {
+			conflicts++
+			return true, nil, apierrors.NewConflict(schema.GroupResource{Group: "apps", Resource: "deployments"}, "worker", errors.New("modified"))
+		}
+		return false, nil, nil
+	})
+	if err := target.scale(&scaleDecision{Replicas: 5, OldestAge: unknownAge}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := conflicts, 1; got != want {
+		t.Errorf("Expected %d conflicts, got: %d", want, got)
+	}
+	deployment, err := c.AppsV1().Deployments("jobs").Get("worker", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := *deployment.Spec.Replicas, int32(5); got != want {
+		t.Errorf("Expected replicas=%d, got: %d", want, got)
+	}
+}
+
+func TestKubeTargetScaleConflictReplicasChanged(t *testing.T) {
+	replicas := int32(2)
+	c := newScaleClientset(&appsv1.Deployment{
+		ObjectMeta: v1.ObjectMeta{Name: "worker", Namespace: "jobs", ResourceVersion: "1"},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+	})
+	target := startTestTarget(t, c, deploymentKind)
+
+	c.PrependReactor("update", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		scale := action.(k8stesting.UpdateAction).GetObject().(*autoscalingv1.Scale)
+		if scale.ResourceVersion != "1" {
+			return false, nil, nil
+		}
+		// scaled by someone else meanwhile
+		obj, err := c.Tracker().Get(action.GetResource(), "jobs", "worker")
+		if err != nil {
+			return true, nil, err
+		}
+		changed := int32(8)
+		obj.(*appsv1.Deployment).Spec.Replicas = &changed
+		if err := c.Tracker().Update(action.GetResource(), obj, "jobs"); err != nil {
+			return true, nil, err
+		}
+		return true, nil, apierrors.NewConflict(schema.GroupResource{Group: "apps", Resource: "deployments"}, "worker", errors.New("modified"))
+	})
+	d := &scaleDecision{Replicas: 5, OldestAge: unknownAge}
+	if err := target.scale(d); err != nil {
+		t.Fatal(err)
+	}
+	deployment, err := c.AppsV1().Deployments("jobs").Get("worker", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := *deployment.Spec.Replicas, int32(8); got != want {
+		t.Errorf("Expected replicas=%d, got: %d", want, got)
+	}
+	if got, want := d.Scaled, int32(8); got != want {
+		t.Errorf("Expected scaled=%d, got: %d", want, got)
+	}
+	for _, reason := range eventReasons(t, c) {
+		if reason == reasonSuccessfulRescale {
+			t.Errorf("Expected no %s event", reasonSuccessfulRescale)
+		}
+	}
+}
+
+func TestKubeTargetNotFound(t *testing.T) {
+	target := startTestTarget(t, fake.NewSimpleClientset(), deploymentKind)
+	if err := target.scale(&scaleDecision{Replicas: 2}); err == nil {
+		t.Fatal("Expected error")
+	}
+}
+
 func TestAPIConfigNoURL(t *testing.T) {
 	_, err := apiConfig("", "", "", "", "", false)
 	if got, want := err.Error(), "API URL must be defined"; got != want {
@@ -68,14 +359,85 @@ func TestAPIConfigTokenNonExistentFile(t *testing.T) {
 	}
 }
 
-func TestAPIContextClientNoURL(t *testing.T) {
-	ctx := apiContext{}
-	_, err := ctx.client()
-	if err == nil {
+func TestAPIConfigTokenFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("secret")
+	f.Close()
+
+	c, err := apiConfig("http://127.0.0.1:8080", "", "", f.Name(), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.BearerToken, "secret"; got != want {
+		t.Errorf("Expected token='%s', got: '%s'", want, got)
+	}
+	if got, want := c.BearerTokenFile, f.Name(); got != want {
+		t.Errorf("Expected token file='%s', got: '%s'", want, got)
+	}
+}
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: dev
+  cluster:
+    server: https://dev.example.com:6443
+- name: prod
+  cluster:
+    server: https://prod.example.com:6443
+users:
+- name: admin
+  user:
+    token: secret
+contexts:
+- name: dev
+  context:
+    cluster: dev
+    user: admin
+- name: prod
+  context:
+    cluster: prod
+    user: admin
+current-context: dev
+`
+
+func TestAPIContextKubeconfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(testKubeconfig)
+	f.Close()
+
+	for context, want := range map[string]string{"": "https://dev.example.com:6443", "prod": "https://prod.example.com:6443"} {
+		ctx := apiContext{Kubeconfig: f.Name(), Context: context}
+		c, err := ctx.config()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.Host; got != want {
+			t.Errorf("Expected host='%s' for context '%s', got: '%s'", want, context, got)
+		}
+		if got, want := c.BearerToken, "secret"; got != want {
+			t.Errorf("Expected token='%s', got: '%s'", want, got)
+		}
+	}
+
+	ctx := apiContext{Kubeconfig: f.Name(), Context: "staging"}
+	if _, err := ctx.config(); err == nil {
 		t.Fatal("Expected error")
 	}
-	if got, want := err.Error(), "API URL must be defined"; got != want {
-		t.Errorf("Expected error='%s', got: '%s'", want, got)
+}
+
+func TestAPIContextClientNoConfig(t *testing.T) {
+	ctx := apiContext{Kubeconfig: "/tmp/file-that-does-not-exist"}
+	if _, err := ctx.client(); err == nil {
+		t.Fatal("Expected error")
 	}
 }
 
@@ -85,6 +447,9 @@ func TestAPIContextClientURL(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	if got, want := ctx.clientConf.UserAgent, fieldManager; got != want {
+		t.Errorf("Expected user agent='%s', got: '%s'", want, got)
+	}
 }
 
 func TestMaxEqual(t *testing.T) {
@@ -199,3 +564,153 @@ func TestScaleBoundsNewSizeSmallerThanMin(t *testing.T) {
 		t.Errorf("Expected newSize='%d', got: '%d'", want, got)
 	}
 }
+
+func TestScaleBoundsLimit(t *testing.T) {
+	b := scaleBounds{Min: 1, Max: 10, IncreaseLimit: 3, DecreaseLimit: 2}
+	tests := []struct {
+		size, newSize int32
+		want          int32
+		bound         string
+	}{
+		{4, 5, 5, ""},
+		{4, 9, 7, boundIncreaseLimit},
+		{9, 12, 10, boundMax},
+		{6, 2, 4, boundDecreaseLimit},
+		{2, 0, 1, boundMin},
+	}
+	for _, tt := range tests {
+		got, bound := b.limit(tt.size, tt.newSize)
+		if got != tt.want || bound != tt.bound {
+			t.Errorf("Expected %d limited by '%s' for %d->%d, got: %d limited by '%s'", tt.want, tt.bound, tt.size, tt.newSize, got, bound)
+		}
+	}
+}
+
+func TestScaleBoundsResize(t *testing.T) {
+	b := scaleBounds{Min: 1, Max: 10, IncreaseLimit: 3}
+	d := &scaleDecision{Replicas: 2, OldestAge: 180, TargetAge: 60}
+	if got, want := b.resize(d, 4), int32(7); got != want {
+		t.Errorf("Expected resize='%d', got: '%d'", want, got)
+	}
+	if d.Current != 4 || d.Desired != 12 || d.Scaled != 7 || d.Bound != boundIncreaseLimit {
+		t.Errorf("Expected sizes 4, 12, 7 limited by '%s', got: %+v", boundIncreaseLimit, d)
+	}
+}
+
+func TestRecordEvent(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	recordEvent(c, deploymentKind, &v1.ObjectMeta{Name: "worker", Namespace: "jobs", UID: "1234"},
+		&scaleEvent{Type: corev1.EventTypeWarning, Reason: "DegradedMode", Message: "No queue statistics"}, ts)
+
+	events, err := c.CoreV1().Events("jobs").List(v1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(events.Items), 1; got != want {
+		t.Fatalf("Expected %d events, got: %d", want, got)
+	}
+	e := events.Items[0]
+	if got, want := e.InvolvedObject.Name, "worker"; got != want {
+		t.Errorf("Expected object='%s', got: '%s'", want, got)
+	}
+	if got, want := e.Reason, "DegradedMode"; got != want {
+		t.Errorf("Expected reason='%s', got: '%s'", want, got)
+	}
+	if got, want := e.Source.Component, eventComponent; got != want {
+		t.Errorf("Expected source='%s', got: '%s'", want, got)
+	}
+	if got, want := e.LastTimestamp.Time, ts; !got.Equal(want) {
+		t.Errorf("Expected timestamp='%v', got: '%v'", want, got)
+	}
+}
+
+func TestRecordEventNone(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	recordEvent(c, deploymentKind, &v1.ObjectMeta{Name: "worker", Namespace: "jobs"}, nil, time.Now())
+
+	events, err := c.CoreV1().Events("jobs").List(v1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(events.Items), 0; got != want {
+		t.Errorf("Expected %d events, got: %d", want, got)
+	}
+}
+
+// waitForCache waits until the cached replica set has replicas
+func waitForCache(t *testing.T, target *kubeTarget, replicas int32) {
+	for i := 0; i < 100; i++ {
+		rs, err := target.replicaSets.ReplicaSets("jobs").Get("worker")
+		if err == nil && *rs.Spec.Replicas == replicas {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d replicas in the cache", replicas)
+}
+
+func TestKubeTargetStartupGrace(t *testing.T) {
+	replicas := int32(2)
+	c := newScaleClientset(&appsv1.ReplicaSet{
+		ObjectMeta: v1.ObjectMeta{Name: "worker", Namespace: "jobs"},
+		Spec:       appsv1.ReplicaSetSpec{Replicas: &replicas},
+		Status:     appsv1.ReplicaSetStatus{Replicas: 2, ReadyReplicas: 2},
+	})
+	target := startTestTarget(t, c, replicaSetKind)
+	clk := newFakeClock(time.Unix(1500000000, 0))
+	target.Clock = clk
+	target.StartupGrace = 90 * time.Second
+
+	if err := target.scale(&scaleDecision{Replicas: 5, OldestAge: unknownAge}); err != nil {
+		t.Fatal(err)
+	}
+	waitForCache(t, target, 5)
+
+	// 3 replicas are starting
+	clk.Advance(30 * time.Second)
+	d := &scaleDecision{Replicas: 8, OldestAge: unknownAge}
+	if err := target.scale(d); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := d.Held, heldStarting; got != want {
+		t.Errorf("Expected held='%s', got: '%s'", want, got)
+	}
+	if got, want := d.Scaled, int32(5); got != want {
+		t.Errorf("Expected scaled=%d, got: %d", want, got)
+	}
+	if got, want := testutil.ToFloat64(startingReplicas), 3.0; got != want {
+		t.Errorf("Expected starting replicas=%v, got: %v", want, got)
+	}
+	if got, want := strings.Join(eventReasons(t, c), ","), "ScalingHeld,SuccessfulRescale"; got != want {
+		t.Errorf("Expected events '%s', got: '%s'", want, got)
+	}
+
+	// replicas desired beyond the starting ones are scaled up
+	d = &scaleDecision{Replicas: 12, Current: 5, Desired: 12, Scaled: 10, Bound: boundMax}
+	if target.holdStarting(d, 2); len(d.Held) > 0 {
+		t.Errorf("Expected scaling up beyond the starting replicas not to be held, got: '%s'", d.Held)
+	}
+	if got, want := d.Scaled, int32(9); got != want {
+		t.Errorf("Expected scaled=%d, got: %d", want, got)
+	}
+	if got, want := d.Bound, ""; got != want {
+		t.Errorf("Expected bound='%s', got: '%s'", want, got)
+	}
+
+	// scaling down is not held
+	d = &scaleDecision{Replicas: 4, Current: 5, Desired: 4, Scaled: 4}
+	if target.holdStarting(d, 2); len(d.Held) > 0 {
+		t.Errorf("Expected scaling down not to be held, got: '%s'", d.Held)
+	}
+
+	// replicas not ready after the grace period don't hold scaling up
+	clk.Advance(60 * time.Second)
+	d = &scaleDecision{Replicas: 8, OldestAge: unknownAge}
+	if err := target.scale(d); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := d.Scaled, int32(8); got != want {
+		t.Errorf("Expected scaled=%d, got: %d", want, got)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+var (
+	leader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "leader",
+		Help:      "Set to 1 when this replica holds the lease and scales the resource.",
+	})
+	leaderTransitions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "leader_transitions_total",
+		Help:      "Number of times this replica became the leader.",
+	})
+)
+
+// leaderElection elects the replica scaling the resource by holding the
+// Lease, the other replicas keep sampling the queues to take over with
+// the whole evaluation window
+type leaderElection struct {
+	Namespace     string
+	Name          string
+	Identity      string
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+
+	leading int32
+}
+
+// Leading reports whether this replica is the leader
+func (le *leaderElection) Leading() bool {
+	return atomic.LoadInt32(&le.leading) == 1
+}
+
+// run campaigns for the lease until ctx is done, the lease is released
+// then so another replica takes over without waiting for it to expire
+func (le *leaderElection) run(ctx context.Context, c kubernetes.Interface) error {
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  v1.ObjectMeta{Namespace: le.Namespace, Name: le.Name},
+			Client:     c.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: le.Identity},
+		},
+		LeaseDuration:   le.LeaseDuration,
+		RenewDeadline:   le.RenewDeadline,
+		RetryPeriod:     le.RetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            le.Name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				log.Printf("Became the leader holding lease '%s', scaling the resource", le.Name)
+				le.setLeading(true)
+				leaderTransitions.Inc()
+			},
+			OnStoppedLeading: func() {
+				if le.Leading() {
+					log.Printf("Lost lease '%s', sampling queues only", le.Name)
+				}
+				le.setLeading(false)
+			},
+			OnNewLeader: func(identity string) {
+				if identity != le.Identity {
+					log.Printf("Replica '%s' is the leader", identity)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	// Run returns when the leadership is lost, campaign again
+	for ctx.Err() == nil {
+		elector.Run(ctx)
+	}
+	return nil
+}
+
+// leaderStore adds samples on the leader only, for a store shared by the
+// replicas which would count every sample once per replica
+type leaderStore struct {
+	SampleStore
+	leading func() bool
+}
+
+// leaderOnly wraps store to add samples on the leader only
+func leaderOnly(store SampleStore, leading func() bool) SampleStore {
+	return &leaderStore{SampleStore: store, leading: leading}
+}
+
+func (s *leaderStore) Add(count int, age float64) error {
+	if !s.leading() {
+		return nil
+	}
+	return s.SampleStore.Add(count, age)
+}
+
+func (s *leaderStore) AddAt(now time.Time, count int, age float64) error {
+	if !s.leading() {
+		return nil
+	}
+	return s.SampleStore.AddAt(now, count, age)
+}
+
+func (le *leaderElection) setLeading(leading bool) {
+	var value int32
+	if leading {
+		value = 1
+	}
+	atomic.StoreInt32(&le.leading, value)
+	leader.Set(float64(value))
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestElection(identity string) *leaderElection {
+	return &leaderElection{Namespace: "jobs",
+		Name:          "worker-amqp-autoscaler",
+		Identity:      identity,
+		LeaseDuration: 2 * time.Second,
+		RenewDeadline: time.Second,
+		RetryPeriod:   100 * time.Millisecond,
+	}
+}
+
+func waitForLeader(t *testing.T, le *leaderElection) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !le.Leading() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s to lead", le.Identity)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLeaderElectionHandover(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	first, second := newTestElection("autoscaler-0"), newTestElection("autoscaler-1")
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- first.run(ctx1, c) }()
+	waitForLeader(t, first)
+	if got, want := testutil.ToFloat64(leader), 1.0; got != want {
+		t.Errorf("Expected leader=%v, got: %v", want, got)
+	}
+
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	go second.run(ctx2, c)
+	time.Sleep(300 * time.Millisecond)
+	if second.Leading() {
+		t.Fatal("Expected a single leader")
+	}
+
+	// the released lease is taken over before it expires
+	start := time.Now()
+	cancel1()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if first.Leading() {
+		t.Error("Expected first replica to stop leading")
+	}
+	waitForLeader(t, second)
+	if elapsed := time.Since(start); elapsed >= second.LeaseDuration {
+		t.Errorf("Expected handover before the lease expires, took: %v", elapsed)
+	}
+
+	lease, err := c.CoordinationV1().Leases("jobs").Get("worker-amqp-autoscaler", v1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := *lease.Spec.HolderIdentity, "autoscaler-1"; got != want {
+		t.Errorf("Expected holder='%s', got: '%s'", want, got)
+	}
+}
+
+func TestLeaderOnlySharedStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autoscale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	clk := newFakeClock(time.Unix(1500000000, 0))
+	series := sampleSeries{Target: "jobs/Deployment/worker", Queue: "tasks"}
+	var stores []*sqlStore
+	for i := 0; i < 2; i++ {
+		store, err := newSQLStore(clk, filepath.Join(dir, "stats.db"), series, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		stores = append(stores, store)
+	}
+
+	// both replicas sampling into the series count every sample twice
+	for i := 0; i < 4; i++ {
+		for _, store := range stores {
+			store.Add(10, unknownAge)
+		}
+		clk.Advance(5 * time.Second)
+	}
+	stats, err := stores[1].Stats(20, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stats.Coverage, 2.0; got != want {
+		t.Errorf("Expected coverage='%v' of two writers, got: '%v'", want, got)
+	}
+
+	clk.Advance(time.Minute)
+	leaders := []bool{true, false}
+	for i := 0; i < 2; i++ {
+		for r, store := range stores {
+			r := r
+			leaderOnly(store, func() bool { return leaders[r] }).Add(10, unknownAge)
+		}
+		clk.Advance(5 * time.Second)
+	}
+	stats, err = stores[1].Stats(20, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stats.Coverage, 0.5; got != want {
+		t.Errorf("Expected coverage='%v' of the leader samples, got: '%v'", want, got)
+	}
+
+	// samples added to the series of each queue as well
+	follower := queueStores{{Queue: "tasks", Store: leaderOnly(stores[0], func() bool { return false })}}
+	follower.poll(clk, func([]string) []queueSample { return []queueSample{{Name: "tasks", Messages: 10}} })([]string{"tasks"})
+	stats, err = stores[1].Stats(20, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stats.Coverage, 0.5; got != want {
+		t.Errorf("Expected coverage='%v' of the leader samples, got: '%v'", want, got)
+	}
+}
@@ -6,14 +6,18 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -21,13 +25,35 @@ import (
 
 func init() {
 	setVersion()
-	flag.StringVar(&brokerURIParam, "amqp-uri", "", "RabbitMQ broker URI")
+	flag.StringVar(&brokerURIParam, "amqp-uri", "", "RabbitMQ broker URI. Use comma separator to specify multiple nodes of a cluster.")
 	flag.StringVar(&queueNameParam, "amqp-queue", "", "RabbitMQ queue to measure load on an application. Use comma separator to specify multiple queues.")
-	flag.StringVar(&apiURLParam, "api-url", "", "Kubernetes API URL")
+	flag.StringVar(&brokerCAFileParam, "amqp-cafile", "", "path to CA certificate file for AMQPS and HTTPS connections to RabbitMQ")
+	flag.StringVar(&brokerCertFileParam, "amqp-cert", "", "path to client certificate file for AMQPS and HTTPS connections to RabbitMQ")
+	flag.StringVar(&brokerKeyFileParam, "amqp-key", "", "path to client private key file for AMQPS and HTTPS connections to RabbitMQ")
+	flag.StringVar(&brokerServerNameParam, "amqp-server-name", "", "server name used to verify RabbitMQ broker TLS certificate, defaults to the host from amqp-uri")
+	flag.BoolVar(&brokerExternalAuthParam, "amqp-external-auth", false, "set to `true` for authenticating to RabbitMQ broker with client certificate using SASL EXTERNAL mechanism")
+	flag.BoolVar(&brokerInsecureParam, "amqp-insecure", false, "set to `true` for connecting to RabbitMQ without verifying TLS certificate; unsafe, use for development only")
+	flag.IntVar(&brokerRetryParam, "amqp-retry-interval", 30, "time in seconds a failed RabbitMQ cluster node is skipped before it is tried again")
+	flag.BoolVar(&brokerBulkParam, "amqp-bulk", true, "set to `false` for requesting RabbitMQ management API for each queue separately instead of listing all queues at once")
+	flag.IntVar(&brokerTimeoutParam, "amqp-timeout", 10, "timeout in seconds for connections and requests to RabbitMQ")
+	flag.StringVar(&pollFailureParam, "poll-failure", failSample, "what to do when some of the queues fail to poll: `fail` the whole sample, `skip` the failed queues or reuse their `last-known` length")
+	flag.IntVar(&pollFailureMaxAgeParam, "poll-failure-max-age", 60, "time in seconds the last known queue length can be reused with `-poll-failure=last-known`")
+	flag.StringVar(&httpURLParam, "http-url", "", "URL of an HTTP endpoint returning queue length as JSON, used instead of RabbitMQ broker; `{queue}` is replaced with the queue name")
+	flag.StringVar(&httpJSONPathParam, "http-jsonpath", "", "JSONPath expression extracting queue length from the HTTP endpoint response, e.g. `{.backlog.size}`")
+	flag.Var(httpHeadersParam, "http-header", "HTTP header `Name: value` sent to the HTTP endpoint, can be repeated")
+	flag.StringVar(&httpTokenParam, "http-token", "", "path to a bearer token file for the HTTP endpoint")
+	flag.StringVar(&httpCAFileParam, "http-cafile", "", "path to CA certificate file for HTTPS connections to the HTTP endpoint")
+	flag.StringVar(&httpCertFileParam, "http-cert", "", "path to client certificate file for HTTPS connections to the HTTP endpoint")
+	flag.StringVar(&httpKeyFileParam, "http-key", "", "path to client private key file for HTTPS connections to the HTTP endpoint")
+	flag.BoolVar(&httpInsecureParam, "http-insecure", false, "set to `true` for connecting to the HTTP endpoint without verifying TLS certificate; unsafe, use for development only")
+	flag.IntVar(&httpTimeoutParam, "http-timeout", 10, "timeout in seconds for requests to the HTTP endpoint")
+	flag.StringVar(&apiURLParam, "api-url", "", "Kubernetes API URL, the in-cluster service account or kubeconfig is used when not set")
 	flag.StringVar(&apiUserParam, "api-user", "", "username for basic authentication on Kubernetes API")
 	flag.StringVar(&apiPasswdParam, "api-passwd", "", "password for basic authentication on Kubernetes API")
 	flag.StringVar(&apiTokenParam, "api-token", "", "path to a bearer token file for OAuth authentication")
 	flag.StringVar(&apiCAFileParam, "api-cafile", "", "path to CA certificate file for HTTPS connections")
+	flag.StringVar(&kubeconfigParam, "kubeconfig", "", "path to a kubeconfig file, defaults to KUBECONFIG environment variable and ~/.kube/config outside of the cluster")
+	flag.StringVar(&contextParam, "context", "", "kubeconfig context, defaults to the current context")
 	flag.BoolVar(&apiInsecureParam, "api-insecure", false, "set to `true` for connecting to Kubernetes API without verifying TLS certificate; unsafe, use for development only")
 	flag.IntVar(&minParam, "min", 1, "lower limit for the number of replicas for a Kubernetes pod that can be set by the autoscaler")
 	flag.IntVar(&maxParam, "max", -1, "upper limit for the number of replicate for a Kubernetes pod that can be set by the autoscaler")
@@ -36,27 +62,61 @@ func init() {
 	flag.StringVar(&namespaceParam, "ns", "default", "Kubernetes namespace")
 	flag.IntVar(&intervalParam, "interval", 30, "time interval between Kubernetes resource scale runs in secs")
 	flag.IntVar(&thresholdParam, "threshold", -1, "number of messages on a queue representing maximum load on the autoscaled Kubernetes resource")
+	flag.IntVar(&targetAgeParam, "target-message-age", 0, "maximum acceptable age in seconds of the oldest message on the queues, replicas are increased when exceeded; requires RabbitMQ management API and messages published with timestamp property, 0 disables")
+	flag.StringVar(&fallbackParam, "fallback", fallbackHold, "what to do after `fallback-after` intervals without queue statistics: `hold` current replicas, scale to `fallback-replicas` with `replicas` or scale to `max`")
+	flag.IntVar(&fallbackAfterParam, "fallback-after", 3, "number of consecutive autoscale intervals without queue statistics before the fallback is applied, 0 disables")
+	flag.IntVar(&fallbackReplicasParam, "fallback-replicas", -1, "number of replicas set with `-fallback=replicas`")
+	flag.StringVar(&rolloutHoldParam, "rollout-hold", holdNone, "scaling of a Deployment held while its rollout is in progress or paused: `none`, `scale-down` or `all`")
+	flag.IntVar(&startupGraceParam, "startup-grace", 0, "time in seconds after scaling up during which replicas not ready yet are counted as capacity consuming the queue and hold further scaling up, 0 disables")
+	flag.BoolVar(&capacityCheckParam, "capacity-check", false, "set to `true` for holding scaling up while pods of the resource can't be scheduled and limiting it to resource quota headroom of the namespace")
+	flag.BoolVar(&leaderElectParam, "leader-elect", false, "set to `true` for running several replicas of the autoscaler, only the one holding the Lease scales the resource")
+	flag.StringVar(&leaderLeaseParam, "leader-elect-lease", "", "name of the Lease in the namespace of the resource, defaults to the resource name with `-amqp-autoscaler` suffix")
+	flag.IntVar(&leaseDurationParam, "leader-elect-lease-duration", 15, "time in seconds the other replicas wait before taking over a Lease which has not been renewed")
+	flag.IntVar(&renewDeadlineParam, "leader-elect-renew-deadline", 10, "time in seconds the leader retries renewing the Lease before it gives up leading")
+	flag.IntVar(&retryPeriodParam, "leader-elect-retry-period", 2, "time in seconds between attempts to acquire or renew the Lease")
 	flag.IntVar(&increaseLimitParam, "increase-limit", -1, "number of messages on a queue representing maximum load on the autocaled Kubernetes resource")
 	flag.IntVar(&decreaseLimitParam, "decrease-limit", -1, "number of messages on a queue representing maximum load on the autocaled Kubernetes resource")
 	flag.IntVar(&statsIntervalParam, "stats-interval", 5, "time interval between metrics gathering runs in seconds")
 	flag.IntVar(&evalIntervalsParam, "eval-intervals", 2, "number of autoscale intervals used to calculate average queue length")
+	flag.StringVar(&aggregationParam, "aggregation", aggAverage, "aggregation of queue lengths over the evaluation window compared with the threshold, one of "+strings.Join(aggregations, ", "))
 	flag.Float64Var(&statsCoverageParam, "stats-coverage", 0.75, "required percentage of statistics to calculate average queue length")
-	flag.StringVar(&dbFileParam, "db", "file::memory:?cache=shared", "sqlite3 database filename")
+	flag.StringVar(&dbFileParam, "db", "", "sqlite3 database filename or PostgreSQL URL for persistent statistics, statistics are kept in memory when not set")
 	flag.StringVar(&dbDirParam, "db-dir", "", "directory for sqlite3 statistics database file")
-	flag.StringVar(&metricsListenAddr, "metrics-listen-address", ":9505", "the address to listen on for exporting prometheus metrics")
+	flag.StringVar(&auditFileParam, "audit-file", "", "JSON lines file recording every autoscale interval, intervals are recorded in the statistics database when not set and `-db` is")
+	flag.IntVar(&auditRetentionParam, "audit-retention", 168, "time in hours the autoscale intervals are kept in the audit log")
+	flag.BoolVar(&externalMetricsParam, "external-metrics", false, "set to `true` for serving queue statistics through the Kubernetes external metrics API for an HPA instead of scaling the resource")
+	flag.StringVar(&externalMetricsAddrParam, "external-metrics-listen-address", ":6443", "the address to listen on for serving the external metrics API over HTTPS")
+	flag.StringVar(&externalMetricsCertParam, "external-metrics-cert", "", "path to certificate file for serving the external metrics API, a self-signed certificate is generated when not set")
+	flag.StringVar(&externalMetricsKeyParam, "external-metrics-key", "", "path to private key file for serving the external metrics API")
+	flag.StringVar(&externalMetricsClientCAParam, "external-metrics-client-ca", "", "path to CA certificate file verifying client certificates required by the external metrics API, e.g. the front proxy CA of the API server")
+	flag.StringVar(&kedaListenAddrParam, "keda-listen-address", "", "the address to listen on for serving KEDA external scaler gRPC service instead of scaling the resource, disabled when not set")
+	flag.StringVar(&metricsListenAddr, "metrics-listen-address", ":9505", "the address to listen on for exporting prometheus metrics and serving the API")
 
 	flag.BoolVar(&version, "version", false, "show version")
 
 	prometheus.MustRegister(queueSizeCount)
 	prometheus.MustRegister(queueSizeAverage)
 	prometheus.MustRegister(queueSizeCoverage)
+	prometheus.MustRegister(queueSizeAggregate)
 	prometheus.MustRegister(buildInfo)
 	prometheus.MustRegister(queueCountSuccesses)
 	prometheus.MustRegister(queueCountFailures)
+	prometheus.MustRegister(oldestMessageAge)
+	prometheus.MustRegister(managementErrors)
+	prometheus.MustRegister(queuePollFailures)
+	prometheus.MustRegister(brokerUp)
+	prometheus.MustRegister(lastSampleNode)
+	prometheus.MustRegister(brokerFailovers)
 	prometheus.MustRegister(pollCount)
 	prometheus.MustRegister(autoscaleErrors)
 	prometheus.MustRegister(desiredReplicas)
+	prometheus.MustRegister(degradedMode)
 	prometheus.MustRegister(scalingEvents)
+	prometheus.MustRegister(rolloutHold)
+	prometheus.MustRegister(startingReplicas)
+	prometheus.MustRegister(scaleUpFrozen)
+	prometheus.MustRegister(leader)
+	prometheus.MustRegister(leaderTransitions)
 	prometheus.MustRegister(minPods)
 	prometheus.MustRegister(maxPods)
 	prometheus.MustRegister(scaleThreshold)
@@ -67,30 +127,74 @@ const (
 )
 
 var (
-	version            bool
-	brokerURIParam     string
-	queueNameParam     string
-	apiURLParam        string
-	apiUserParam       string
-	apiPasswdParam     string
-	apiTokenParam      string
-	apiCAFileParam     string
-	apiInsecureParam   bool
-	minParam           int
-	maxParam           int
-	nameParam          string
-	kindParam          string
-	namespaceParam     string
-	intervalParam      int
-	thresholdParam     int
-	increaseLimitParam int
-	decreaseLimitParam int
-	evalIntervalsParam int
-	statsCoverageParam float64
-	statsIntervalParam int
-	dbFileParam        string
-	dbDirParam         string
-	metricsListenAddr  string
+	version                 bool
+	brokerURIParam          string
+	queueNameParam          string
+	brokerCAFileParam       string
+	brokerCertFileParam     string
+	brokerKeyFileParam      string
+	brokerServerNameParam   string
+	brokerExternalAuthParam bool
+	brokerInsecureParam     bool
+	brokerTimeoutParam      int
+	brokerRetryParam        int
+	brokerBulkParam         bool
+	pollFailureParam        string
+	pollFailureMaxAgeParam  int
+	httpURLParam            string
+	httpJSONPathParam       string
+	httpHeadersParam        = headerFlags{}
+	httpTokenParam          string
+	httpCAFileParam         string
+	httpCertFileParam       string
+	httpKeyFileParam        string
+	httpInsecureParam       bool
+	httpTimeoutParam        int
+	apiURLParam             string
+	apiUserParam            string
+	apiPasswdParam          string
+	apiTokenParam           string
+	apiCAFileParam          string
+	apiInsecureParam        bool
+	kubeconfigParam         string
+	contextParam            string
+	minParam                int
+	maxParam                int
+	nameParam               string
+	kindParam               string
+	namespaceParam          string
+	intervalParam           int
+	thresholdParam          int
+	targetAgeParam          int
+	fallbackParam           string
+	fallbackAfterParam      int
+	fallbackReplicasParam   int
+	rolloutHoldParam        string
+	startupGraceParam       int
+	capacityCheckParam      bool
+	leaderElectParam        bool
+	leaderLeaseParam        string
+	leaseDurationParam      int
+	renewDeadlineParam      int
+	retryPeriodParam        int
+	increaseLimitParam      int
+	decreaseLimitParam      int
+	evalIntervalsParam      int
+	statsCoverageParam      float64
+	aggregationParam        string
+	statsIntervalParam      int
+	dbFileParam             string
+	dbDirParam              string
+	auditFileParam          string
+	auditRetentionParam     int
+	metricsListenAddr       string
+
+	externalMetricsParam         bool
+	externalMetricsAddrParam     string
+	externalMetricsCertParam     string
+	externalMetricsKeyParam      string
+	externalMetricsClientCAParam string
+	kedaListenAddrParam          string
 
 	buildInfo = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -145,39 +249,110 @@ var (
 		},
 		[]string{"queue"},
 	)
+	queueSizeAggregate = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "aggregated_queue_size",
+			Help:      "Size of target queue aggregated over the evaluation window.",
+		},
+		[]string{"queue", "aggregation"},
+	)
 )
 
 func validateParams() error {
-	if len(brokerURIParam) == 0 {
+	if len(brokerURIParam) == 0 && len(httpURLParam) == 0 {
 		return errors.New("Missing RabbitMQ URI")
 	}
+	if brokerExternalAuthParam && (len(brokerCertFileParam) == 0 || len(brokerKeyFileParam) == 0) {
+		return errors.New("Missing client certificate and key for RabbitMQ EXTERNAL authentication")
+	}
+	if brokerTimeoutParam < 1 {
+		return fmt.Errorf("Invalid RabbitMQ timeout '%d'", brokerTimeoutParam)
+	}
+	if brokerRetryParam < 0 {
+		return fmt.Errorf("Invalid RabbitMQ node retry interval '%d'", brokerRetryParam)
+	}
+	switch pollFailureParam {
+	case failSample, skipQueue, lastKnown:
+	default:
+		return fmt.Errorf("Invalid poll failure strategy '%s'", pollFailureParam)
+	}
+	if pollFailureMaxAgeParam < 0 {
+		return fmt.Errorf("Invalid last known queue length max age '%d'", pollFailureMaxAgeParam)
+	}
+	if len(httpURLParam) > 0 && len(httpJSONPathParam) == 0 {
+		return errors.New("Missing JSONPath expression for HTTP endpoint")
+	}
+	if len(httpURLParam) > 0 && httpTimeoutParam < 1 {
+		return fmt.Errorf("Invalid HTTP endpoint timeout '%d'", httpTimeoutParam)
+	}
 	if len(queueNameParam) == 0 {
 		return errors.New("Missing RabbitMQ queue name")
 	}
-	if len(apiURLParam) == 0 {
-		return errors.New("Missing Kubernetes API URL")
+	if len(apiURLParam) > 0 && (len(kubeconfigParam) > 0 || len(contextParam) > 0) {
+		return errors.New("Kubernetes API URL and kubeconfig are mutually exclusive")
 	}
 	if intervalParam < 1 {
 		return fmt.Errorf("Invalid auto-scale interval '%d'", intervalParam)
 	}
-	if thresholdParam < 1 {
+	if scalesResource() && thresholdParam < 1 {
 		return fmt.Errorf("Invalid threshold value '%d'", thresholdParam)
 	}
+	if targetAgeParam < 0 {
+		return fmt.Errorf("Invalid target message age '%d'", targetAgeParam)
+	}
 	if intervalParam <= statsIntervalParam {
 		return fmt.Errorf("Interval for saving statistics '%d' should be smaller than auto-scale interval '%d'", statsIntervalParam, intervalParam)
 	}
+	if !isAggregation(aggregationParam) {
+		return fmt.Errorf("Invalid aggregation '%s'", aggregationParam)
+	}
 	if statsCoverageParam > 1.0 || statsCoverageParam < 0.0 {
 		return fmt.Errorf("Invalid metrics coverage ratio '%.2f'", statsCoverageParam)
 	}
 	if minParam < 0 {
 		return fmt.Errorf("Invalid lower limit for the number of pods '%d'", minParam)
 	}
-	if maxParam <= minParam {
+	if scalesResource() && maxParam <= minParam {
 		return fmt.Errorf("Upper limit for the number of pods '%d' must be greater than lower limit '%d'", maxParam, minParam)
 	}
-	if len(nameParam) == 0 {
+	switch fallbackParam {
+	case fallbackHold, fallbackMax:
+	case fallbackReplicas:
+		if fallbackReplicasParam < minParam || fallbackReplicasParam > maxParam {
+			return fmt.Errorf("Fallback replicas '%d' must be between lower limit '%d' and upper limit '%d'", fallbackReplicasParam, minParam, maxParam)
+		}
+	default:
+		return fmt.Errorf("Invalid fallback '%s'", fallbackParam)
+	}
+	if auditRetentionParam < 1 {
+		return fmt.Errorf("Invalid audit retention '%d'", auditRetentionParam)
+	}
+	switch rolloutHoldParam {
+	case holdNone, holdScaleDown, holdAll:
+	default:
+		return fmt.Errorf("Invalid rollout hold '%s'", rolloutHoldParam)
+	}
+	if startupGraceParam < 0 {
+		return fmt.Errorf("Invalid startup grace period '%d'", startupGraceParam)
+	}
+	if leaderElectParam && (retryPeriodParam < 1 || float64(renewDeadlineParam) <= 1.2*float64(retryPeriodParam) ||
+		leaseDurationParam <= renewDeadlineParam) {
+		return fmt.Errorf("Invalid leader election lease duration '%d', renew deadline '%d' and retry period '%d'",
+			leaseDurationParam, renewDeadlineParam, retryPeriodParam)
+	}
+	if fallbackAfterParam < 0 {
+		return fmt.Errorf("Invalid number of intervals before fallback '%d'", fallbackAfterParam)
+	}
+	if (len(externalMetricsCertParam) > 0) != (len(externalMetricsKeyParam) > 0) {
+		return errors.New("Both certificate and key files are required for the external metrics API")
+	}
+	if scalesResource() && len(nameParam) == 0 {
 		return errors.New("Missing name of the resource to autoscale")
 	}
+	if len(dbFileParam) > 0 && len(nameParam) == 0 {
+		return errors.New("Missing name of the resource keeping its samples apart in the statistics database")
+	}
 	if len(kindParam) == 0 {
 		return errors.New("Missing kind of the resource to autoscale")
 	}
@@ -193,9 +368,22 @@ func validateParams() error {
 	return nil
 }
 
+// scalesResource reports whether the autoscaler scales the resource itself
+// instead of serving queue statistics to another autoscaler
+func scalesResource() bool {
+	return !externalMetricsParam && len(kedaListenAddrParam) == 0
+}
+
 const appName = "Kubernetes AMQP Autoscaler"
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		if err := auditCommand(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	flag.Parse()
 
 	if version {
@@ -219,63 +407,264 @@ func main() {
 	log.Printf("System with %d CPUs and environment with %d max processes",
 		runtime.NumCPU(), runtime.GOMAXPROCS(0))
 
+	duration := evalIntervalsParam * intervalParam
+	dbFile := dbFileParam
+	if len(dbFile) > 0 && len(dbDirParam) > 0 && dialectOf(dbFile) == sqliteDialect {
+		path, err := dbPath(dbDirParam, dbFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dbFile = path
+	}
+	series := sampleSeries{Target: namespaceParam + "/" + kindParam + "/" + nameParam, Queue: queueNameParam}
+	store, err := newSampleStore(realClock{}, dbFile, series, duration, statsIntervalParam)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+	// stores of the queues and the audit log share the database
+	var db *metricsDB
+	if s, ok := store.(*sqlStore); ok {
+		db = s.db
+	}
+
+	var audit auditLog
+	retention := time.Duration(auditRetentionParam) * time.Hour
+	if len(auditFileParam) > 0 {
+		audit, err = newFileAudit(realClock{}, auditFileParam, series.Target, retention)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer audit.Close()
+	} else if db != nil {
+		audit = &sqlAudit{clock: realClock{}, db: db, target: series.Target, retention: retention}
+	}
+
 	http.Handle("/metrics", promhttp.Handler())
+	api := &apiHandler{clock: realClock{}, store: store, audit: audit, target: series.Target}
+	api.register(http.DefaultServeMux)
 	go func() {
 		log.Fatal(http.ListenAndServe(metricsListenAddr, nil))
 	}()
 
-	db, err := connectToDB(&dbFileParam)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer db.Close()
-	createTable(db)
-
 	forever := make(chan struct{})
 
-	duration := evalIntervalsParam * intervalParam
-	fsample := func(n int) error { return updateMetrics(db, n, duration) }
+	var election *leaderElection
+	if leaderElectParam && scalesResource() {
+		identity, err := os.Hostname()
+		if err != nil {
+			log.Fatal(err)
+		}
+		lease := leaderLeaseParam
+		if len(lease) == 0 {
+			lease = nameParam + "-amqp-autoscaler"
+		}
+		election = &leaderElection{Namespace: namespaceParam,
+			Name:          lease,
+			Identity:      identity,
+			LeaseDuration: time.Duration(leaseDurationParam) * time.Second,
+			RenewDeadline: time.Duration(renewDeadlineParam) * time.Second,
+			RetryPeriod:   time.Duration(retryPeriodParam) * time.Second,
+		}
+	}
+
+	// the replicas share the series of the database
+	shared := election != nil && len(dbFile) > 0 && dialectOf(dbFile) == postgresDialect
+	if shared {
+		store = leaderOnly(store, election.Leading)
+	}
 
 	queueNames := strings.Split(queueNameParam, ",")
 	log.Printf("Summing over %d queues: %s", len(queueNames), queueNameParam)
-	go monitorQueue(unquoteURI(brokerURIParam), queueNames, statsIntervalParam, fsample, forever)
-
-	fmetrics := func() (*queueMetrics, error) {
-		metrics, err := getMetrics(db, duration, statsIntervalParam)
+	var fpoll queuePoll
+	if len(httpURLParam) > 0 {
+		src := &httpSource{URL: unquoteURI(httpURLParam),
+			JSONPath:  httpJSONPathParam,
+			Headers:   http.Header(httpHeadersParam),
+			TokenFile: httpTokenParam,
+			CAFile:    httpCAFileParam,
+			CertFile:  httpCertFileParam,
+			KeyFile:   httpKeyFileParam,
+			Insecure:  httpInsecureParam,
+			Timeout:   time.Duration(httpTimeoutParam) * time.Second,
+		}
+		if err := src.init(); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Reading queue length from HTTP endpoint %s", src.URL)
+		fpoll = pollEach(lengthSampler(src.queueLength))
+	} else {
+		uris := splitURIs(brokerURIParam)
+		pool, err := newBrokerPool(uris,
+			&brokerOptions{CAFile: brokerCAFileParam,
+				CertFile:     brokerCertFileParam,
+				KeyFile:      brokerKeyFileParam,
+				ServerName:   brokerServerNameParam,
+				ExternalAuth: brokerExternalAuthParam,
+				Insecure:     brokerInsecureParam,
+				Timeout:      time.Duration(brokerTimeoutParam) * time.Second,
+			},
+			time.Duration(brokerRetryParam)*time.Second,
+			brokerBulkParam)
 		if err != nil {
-			queueSizeCount.With(prometheus.Labels{"queue": queueNameParam}).Set(float64(metrics.Count))
-			queueSizeAverage.With(prometheus.Labels{"queue": queueNameParam}).Set(metrics.Average)
-			queueSizeCoverage.With(prometheus.Labels{"queue": queueNameParam}).Set(metrics.Coverage)
+			log.Fatal(err)
 		}
-		return metrics, err
+		log.Printf("Reading queue length from %d RabbitMQ nodes", len(uris))
+		fpoll = pool.poll
+	}
+	policy := &failurePolicy{Strategy: pollFailureParam, MaxAge: time.Duration(pollFailureMaxAgeParam) * time.Second}
+	fpoll = policy.poll(fpoll)
+
+	// samples of a single queue are the ones of the store
+	stores := queueStores{{Queue: queueNameParam, Store: store}}
+	fsample := func(n int, age float64) error { return store.Add(n, age) }
+	if len(queueNames) > 1 && (len(dbFile) > 0 || !scalesResource()) {
+		stores = newQueueStores(realClock{}, db, series.Target, queueNames, duration, statsIntervalParam)
+		if shared {
+			for i := range stores {
+				stores[i].Store = leaderOnly(stores[i].Store, election.Leading)
+			}
+		}
+		if scalesResource() {
+			fpoll = stores.pollTotal(realClock{}, fpoll)
+		} else {
+			fpoll = stores.poll(realClock{}, fpoll)
+		}
+		if len(dbFile) > 0 {
+			// the store sums the series of the queues in the database
+			fsample = func(int, float64) error { return nil }
+		}
+	}
+
+	if !scalesResource() {
+		if externalMetricsParam {
+			metrics := &externalMetrics{clock: realClock{},
+				stores:      stores,
+				duration:    duration,
+				interval:    statsIntervalParam,
+				coverage:    statsCoverageParam,
+				aggregation: aggregationParam,
+			}
+			go func() {
+				log.Fatal(serveExternalMetrics(externalMetricsAddrParam, metrics,
+					externalMetricsCertParam, externalMetricsKeyParam, externalMetricsClientCAParam))
+			}()
+			log.Printf("Serving external metrics API on %s", externalMetricsAddrParam)
+		}
+		if len(kedaListenAddrParam) > 0 {
+			scaler := &kedaScaler{clock: realClock{},
+				all:         store,
+				stores:      stores,
+				duration:    duration,
+				interval:    statsIntervalParam,
+				coverage:    statsCoverageParam,
+				aggregation: aggregationParam,
+				threshold:   thresholdParam,
+			}
+			go func() {
+				log.Fatal(serveKEDA(kedaListenAddrParam, scaler))
+			}()
+			log.Printf("Serving KEDA external scaler on %s", kedaListenAddrParam)
+		}
+		go monitorQueue(realClock{}, fpoll, queueNames, statsIntervalParam, fsample, forever)
+		<-forever
+		return
+	}
+
+	go monitorQueue(realClock{}, fpoll, queueNames, statsIntervalParam, fsample, forever)
+
+	fmetrics := exportStats(store, queueNameParam, duration, statsIntervalParam)
+
+	kubeAPI := &apiContext{URL: unquoteURI(apiURLParam),
+		User:       apiUserParam,
+		Passwd:     apiPasswdParam,
+		TokenFile:  apiTokenParam,
+		CAFile:     apiCAFileParam,
+		Insecure:   apiInsecureParam,
+		Kubeconfig: kubeconfigParam,
+		Context:    contextParam,
+	}
+	client, err := kubeAPI.client()
+	if err != nil {
+		log.Fatal(err)
+	}
+	bounds := &scaleBounds{Min: minParam,
+		Max:           maxParam,
+		IncreaseLimit: increaseLimitParam,
+		DecreaseLimit: decreaseLimitParam}
+	target, err := newKubeTarget(client, kindParam, namespaceParam, nameParam, bounds)
+	if err != nil {
+		log.Fatal(err)
+	}
+	target.RolloutHold = rolloutHoldParam
+	target.StartupGrace = time.Duration(startupGraceParam) * time.Second
+	target.CapacityCheck = capacityCheckParam
+	if err := target.start(forever); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Watching %s '%s' in namespace '%s'", kindParam, nameParam, namespaceParam)
+
+	var leading func() bool
+	if election != nil {
+		// release the lease on termination so another replica takes
+		// over right away
+		ctx, cancel := context.WithCancel(context.Background())
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+		go func() {
+			<-sigs
+			cancel()
+		}()
+		go func() {
+			if err := election.run(ctx, client); err != nil {
+				log.Fatal(err)
+			}
+			close(forever)
+		}()
+		leading = election.Leading
+		log.Printf("Campaigning for lease '%s' in namespace '%s' as '%s'", election.Name, namespaceParam, election.Identity)
 	}
 
-	fscale := func(newSize int32) error {
-		bounds := &scaleBounds{Min: minParam,
-			Max:           maxParam,
-			IncreaseLimit: increaseLimitParam,
-			DecreaseLimit: decreaseLimitParam}
-		return scale(kindParam, namespaceParam, nameParam, newSize,
-			&apiContext{URL: unquoteURI(apiURLParam),
-				User:      apiUserParam,
-				Passwd:    apiPasswdParam,
-				TokenFile: apiTokenParam,
-				CAFile:    apiCAFileParam,
-				Insecure:  apiInsecureParam,
-				Bounds:    bounds,
-			})
+	fallbackReplicas := int32(fallbackReplicasParam)
+	if fallbackParam == fallbackMax {
+		fallbackReplicas = int32(maxParam)
 	}
 
 	go autoscale(fmetrics,
 		&scaleContext{Threshold: thresholdParam,
-			Coverage: statsCoverageParam,
-			Interval: intervalParam,
-			Scaler:   fscale},
+			Coverage:         statsCoverageParam,
+			Aggregation:      aggregationParam,
+			Interval:         intervalParam,
+			TargetAge:        float64(targetAgeParam),
+			Fallback:         fallbackParam,
+			FallbackAfter:    fallbackAfterParam,
+			FallbackReplicas: fallbackReplicas,
+			Window:           duration,
+			Scaler:           target.scale,
+			Audit:            audit,
+			Leading:          leading},
 		forever)
 
 	<-forever
 }
 
+// exportStats returns statistics of the store over the evaluation window,
+// exported as gauges of the queue whenever they could be read
+func exportStats(store SampleStore, queue string, duration, interval int) queueStats {
+	return func() (*queueMetrics, error) {
+		metrics, err := store.Stats(duration, interval)
+		if err == nil {
+			queueSizeCount.With(prometheus.Labels{"queue": queue}).Set(float64(metrics.Count))
+			queueSizeAverage.With(prometheus.Labels{"queue": queue}).Set(metrics.Average)
+			queueSizeCoverage.With(prometheus.Labels{"queue": queue}).Set(metrics.Coverage)
+			for _, agg := range aggregations {
+				queueSizeAggregate.With(prometheus.Labels{"queue": queue, "aggregation": agg}).Set(metrics.aggregate(agg))
+			}
+		}
+		return metrics, err
+	}
+}
+
 // setVersion figures out the version information based on
 // variables set by -ldflags.
 func setVersion() {
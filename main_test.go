@@ -5,7 +5,13 @@
 
 package main
 
-import "testing"
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
 
 func TestSetVersion(t *testing.T) {
 	setVersion()
@@ -55,14 +61,16 @@ func TestValidateParams(t *testing.T) {
 	}
 	queueNameParam = "queue"
 
+	apiURLParam = "http://"
+	contextParam = "prod"
 	err = validateParams()
 	if err == nil {
 		t.Fatal("Expected error")
 	}
-	if got, want := err.Error(), "Missing Kubernetes API URL"; got != want {
+	if got, want := err.Error(), "Kubernetes API URL and kubeconfig are mutually exclusive"; got != want {
 		t.Errorf("Expected error='%s', got: '%s'", want, got)
 	}
-	apiURLParam = "http://"
+	contextParam = ""
 
 	intervalParam = 0
 	err = validateParams()
@@ -131,6 +139,18 @@ func TestValidateParams(t *testing.T) {
 	if got, want := err.Error(), "Missing name of the resource to autoscale"; got != want {
 		t.Errorf("Expected error='%s', got: '%s'", want, got)
 	}
+
+	externalMetricsParam = true
+	dbFileParam = "stats.db"
+	err = validateParams()
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+	if got, want := err.Error(), "Missing name of the resource keeping its samples apart in the statistics database"; got != want {
+		t.Errorf("Expected error='%s', got: '%s'", want, got)
+	}
+	externalMetricsParam = false
+	dbFileParam = ""
 	nameParam = "pod"
 
 	kindParam = ""
@@ -168,3 +188,28 @@ func TestValidateParams(t *testing.T) {
 	}
 
 }
+
+func TestExportStats(t *testing.T) {
+	clk := newFakeClock(time.Unix(1500000000, 0))
+	store := newMemoryStore(clk, 10, 5)
+	for _, count := range []int{4, 8} {
+		if err := store.Add(count, unknownAge); err != nil {
+			t.Fatal(err)
+		}
+		clk.Advance(5 * time.Second)
+	}
+	fmetrics := exportStats(store, "exported", 10, 5)
+	metrics, err := fmetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := testutil.ToFloat64(queueSizeCount.With(prometheus.Labels{"queue": "exported"})), float64(metrics.Count); got != want {
+		t.Errorf("Expected count=%v, got: %v", want, got)
+	}
+	if got, want := testutil.ToFloat64(queueSizeAverage.With(prometheus.Labels{"queue": "exported"})), 6.0; got != want {
+		t.Errorf("Expected average=%v, got: %v", want, got)
+	}
+	if got, want := testutil.ToFloat64(queueSizeAggregate.With(prometheus.Labels{"queue": "exported", "aggregation": aggMax})), 8.0; got != want {
+		t.Errorf("Expected max=%v, got: %v", want, got)
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/streadway/amqp"
+)
+
+// Reasons of failed queue length retrievals
+const (
+	reasonAuth        = "auth_failed"
+	reasonNotFound    = "queue_not_found"
+	reasonUnavailable = "broker_unavailable"
+	reasonBadResponse = "bad_response"
+)
+
+var (
+	managementErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "management_api_errors_total",
+			Help:      "Number of failed RabbitMQ management API requests by reason.",
+		},
+		[]string{"reason"},
+	)
+)
+
+// APIQueueInfo is a subset of a queue object returned by RabbitMQ
+// management API
+type APIQueueInfo struct {
+	Name                 string       `json:"name"`
+	Messages             int          `json:"messages"`
+	HeadMessageTimestamp apiTimestamp `json:"head_message_timestamp"`
+}
+
+func (info *APIQueueInfo) sample() queueSample {
+	return queueSample{Name: info.Name, Messages: info.Messages, HeadTimestamp: time.Time(info.HeadMessageTimestamp)}
+}
+
+// apiTimestamp is a timestamp in seconds since epoch, the management API
+// returns empty value when the message at the head of the queue has no
+// timestamp property
+type apiTimestamp time.Time
+
+func (ts *apiTimestamp) UnmarshalJSON(data []byte) error {
+	var secs int64
+	if err := json.Unmarshal(data, &secs); err != nil || secs <= 0 {
+		*ts = apiTimestamp{}
+		return nil
+	}
+	*ts = apiTimestamp(time.Unix(secs, 0))
+	return nil
+}
+
+// apiQueuePage is a page of queues returned by RabbitMQ management API
+// when pagination is requested
+type apiQueuePage struct {
+	Items     []APIQueueInfo `json:"items"`
+	Page      int            `json:"page"`
+	PageCount int            `json:"page_count"`
+}
+
+// queuePageSize is the maximum page size allowed by RabbitMQ management API
+const queuePageSize = 500
+
+// queueColumns limits queue attributes returned by the management API
+const queueColumns = "name,messages,head_message_timestamp"
+
+// managementError describes failed RabbitMQ management API request
+type managementError struct {
+	Reason string
+	Status int
+	Queue  string
+	Err    error
+}
+
+func (e *managementError) Error() string {
+	msg := "management API " + strings.Replace(e.Reason, "_", " ", -1)
+	if len(e.Queue) > 0 {
+		msg = fmt.Sprintf("%s for queue '%s'", msg, e.Queue)
+	}
+	if e.Status > 0 {
+		msg = fmt.Sprintf("%s (HTTP %d)", msg, e.Status)
+	}
+	if e.Err != nil {
+		msg = fmt.Sprintf("%s: %v", msg, e.Err)
+	}
+	return msg
+}
+
+// errorReason returns reason of a failed queue length retrieval
+func errorReason(err error) string {
+	switch e := err.(type) {
+	case *managementError:
+		return e.Reason
+	case *amqp.Error:
+		switch e.Code {
+		case amqp.NotFound:
+			return reasonNotFound
+		case amqp.AccessRefused:
+			return reasonAuth
+		}
+		return reasonUnavailable
+	case net.Error:
+		return reasonUnavailable
+	}
+	return "error"
+}
+
+// managementClient retrieves queue lengths from RabbitMQ management API,
+// uri has the form of `http[s]://user:passwd@host:port/vhost`
+type managementClient struct {
+	base   *url.URL
+	vhost  string
+	user   *url.Userinfo
+	client *http.Client
+}
+
+func newManagementClient(uri string, opts *brokerOptions) (*managementClient, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.Host) == 0 {
+		return nil, errors.New("missing host in management API URI")
+	}
+	// TLS settings of the broker, the management API is served by its nodes
+	tlsConf, err := tlsConfig(opts.CAFile, opts.CertFile, opts.KeyFile, opts.Insecure)
+	if err != nil {
+		return nil, err
+	}
+	tlsConf.ServerName = opts.ServerName
+	// same vhost convention as AMQP URIs, `//` or no path is the default `/` vhost
+	vhost := "/"
+	if len(u.Path) > 0 {
+		vhost = u.Path[1:]
+	}
+	if len(vhost) == 0 {
+		vhost = "/"
+	}
+	return &managementClient{
+		base:   &url.URL{Scheme: u.Scheme, Host: u.Host},
+		vhost:  vhost,
+		user:   u.User,
+		client: httpClient(tlsConf, opts.Timeout),
+	}, nil
+}
+
+func (mc *managementClient) queueURL(name string) string {
+	return mc.base.String() + "/api/queues/" + url.PathEscape(mc.vhost) + "/" + url.PathEscape(name)
+}
+
+// queueLength returns number of messages on the queue
+func (mc *managementClient) queueLength(name string) (int, error) {
+	s := mc.queueSample(name)
+	return s.Messages, s.Err
+}
+
+// queueSample returns number of messages on the queue and timestamp of
+// the message at its head
+func (mc *managementClient) queueSample(name string) queueSample {
+	info := APIQueueInfo{Name: name}
+	if err := mc.get(mc.queueURL(name), name, &info); err != nil {
+		managementErrors.With(prometheus.Labels{"reason": errorReason(err)}).Inc()
+		return queueSample{Name: name, Err: err}
+	}
+	return info.sample()
+}
+
+// queueSamples returns state of the named queues listing queues of
+// the vhost, queues that don't exist are missing from the result
+func (mc *managementClient) queueSamples(names []string) (map[string]queueSample, error) {
+	samples, err := mc.listQueues(names)
+	if err != nil {
+		managementErrors.With(prometheus.Labels{"reason": errorReason(err)}).Inc()
+	}
+	return samples, err
+}
+
+func (mc *managementClient) listQueues(names []string) (map[string]queueSample, error) {
+	wanted := make(map[string]bool, len(names))
+	patterns := make([]string, 0, len(names))
+	for _, name := range names {
+		if !wanted[name] {
+			wanted[name] = true
+			patterns = append(patterns, regexp.QuoteMeta(name))
+		}
+	}
+	query := url.Values{}
+	query.Set("columns", queueColumns)
+	query.Set("name", "^("+strings.Join(patterns, "|")+")$")
+	query.Set("use_regex", "true")
+	query.Set("page_size", strconv.Itoa(queuePageSize))
+
+	samples := make(map[string]queueSample, len(names))
+	for page, pageCount := 1, 1; page <= pageCount; page++ {
+		query.Set("page", strconv.Itoa(page))
+		var raw json.RawMessage
+		if err := mc.get(mc.base.String()+"/api/queues/"+url.PathEscape(mc.vhost)+"?"+query.Encode(), "", &raw); err != nil {
+			return nil, err
+		}
+		var items []APIQueueInfo
+		if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '[' {
+			// brokers without pagination support return all queues
+			if err := json.Unmarshal(raw, &items); err != nil {
+				return nil, &managementError{Reason: reasonBadResponse, Err: err}
+			}
+		} else {
+			p := apiQueuePage{}
+			if err := json.Unmarshal(raw, &p); err != nil {
+				return nil, &managementError{Reason: reasonBadResponse, Err: err}
+			}
+			items = p.Items
+			pageCount = p.PageCount
+		}
+		for _, item := range items {
+			if wanted[item.Name] {
+				samples[item.Name] = item.sample()
+			}
+		}
+	}
+	return samples, nil
+}
+
+func (mc *managementClient) get(uri, queue string, v interface{}) error {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if mc.user != nil {
+		passwd, _ := mc.user.Password()
+		req.SetBasicAuth(mc.user.Username(), passwd)
+	}
+
+	resp, err := mc.client.Do(req)
+	if err != nil {
+		return &managementError{Reason: reasonUnavailable, Queue: queue, Err: err}
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return &managementError{Reason: reasonUnavailable, Status: resp.StatusCode, Queue: queue, Err: err}
+	}
+
+	if reason := statusReason(resp.StatusCode); len(reason) > 0 {
+		return &managementError{Reason: reason, Status: resp.StatusCode, Queue: queue, Err: apiErrorMessage(body)}
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return &managementError{Reason: reasonBadResponse, Status: resp.StatusCode, Queue: queue, Err: err}
+	}
+	return nil
+}
+
+// statusReason classifies HTTP status codes, returns empty reason for
+// successful responses
+func statusReason(status int) string {
+	switch {
+	case status >= 200 && status < 300:
+		return ""
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return reasonAuth
+	case status == http.StatusNotFound:
+		return reasonNotFound
+	case status >= 500:
+		return reasonUnavailable
+	}
+	return reasonBadResponse
+}
+
+// apiErrorMessage extracts the reason from RabbitMQ JSON error response,
+// other (e.g. HTML) responses are ignored
+func apiErrorMessage(body []byte) error {
+	apiErr := struct {
+		Error  string `json:"error"`
+		Reason string `json:"reason"`
+	}{}
+	if err := json.Unmarshal(body, &apiErr); err != nil || len(apiErr.Reason) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", apiErr.Reason)
+}
@@ -0,0 +1,280 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func managementServer(t *testing.T, status int, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+}
+
+func TestManagementClientQueueLength(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.URL.EscapedPath(), "/api/queues/%2F/tasks"; got != want {
+			t.Errorf("Expected path='%s', got: '%s'", want, got)
+		}
+		user, passwd, ok := r.BasicAuth()
+		if !ok || user != "guest" || passwd != "secret" {
+			t.Errorf("Expected basic auth guest:secret, got: '%s:%s'", user, passwd)
+		}
+		w.Write([]byte(`{"name": "tasks", "messages": 17}`))
+	}))
+	defer ts.Close()
+
+	mc, err := newManagementClient(strings.Replace(ts.URL, "://", "://guest:secret@", 1)+"//", &brokerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := mc.queueLength("tasks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n, 17; got != want {
+		t.Errorf("Expected length=%d, got: %d", want, got)
+	}
+}
+
+func TestManagementClientTLSServerName(t *testing.T) {
+	pki := newTestPKI(t, "rabbitmq.test")
+	defer pki.Remove()
+	serverCert, err := tls.LoadX509KeyPair(pki.ServerCert, pki.ServerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name": "tasks", "messages": 3}`))
+	}))
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	ts.StartTLS()
+	defer ts.Close()
+
+	// the certificate is verified against amqp-server-name, not the host
+	opts := &brokerOptions{CAFile: pki.CAFile, Timeout: 5 * time.Second}
+	mc, err := newManagementClient(ts.URL, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mc.queueLength("tasks"); err == nil {
+		t.Fatal("Expected certificate verification error")
+	}
+	opts.ServerName = "rabbitmq.test"
+	mc, err = newManagementClient(ts.URL, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := mc.queueLength("tasks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n, 3; got != want {
+		t.Errorf("Expected length=%d, got: %d", want, got)
+	}
+}
+
+func TestManagementClientVhost(t *testing.T) {
+	mc, err := newManagementClient("https://rabbitmq:15671/staging", &brokerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mc.queueURL("q 1"), "https://rabbitmq:15671/api/queues/staging/q%201"; got != want {
+		t.Errorf("Expected url='%s', got: '%s'", want, got)
+	}
+}
+
+func TestManagementClientMissingHost(t *testing.T) {
+	_, err := newManagementClient("http://", &brokerOptions{})
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+	if got, want := err.Error(), "missing host in management API URI"; got != want {
+		t.Errorf("Expected error='%s', got: '%s'", want, got)
+	}
+}
+
+func TestManagementClientErrors(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		reason string
+		msg    string
+	}{
+		{http.StatusUnauthorized, `{"error":"not_authorised","reason":"Login failed"}`, reasonAuth,
+			"management API auth failed for queue 'tasks' (HTTP 401): Login failed"},
+		{http.StatusNotFound, `{"error":"Object Not Found","reason":"Not Found"}`, reasonNotFound,
+			"management API queue not found for queue 'tasks' (HTTP 404): Not Found"},
+		{http.StatusServiceUnavailable, `<html>503</html>`, reasonUnavailable,
+			"management API broker unavailable for queue 'tasks' (HTTP 503)"},
+		{http.StatusOK, `<html>login</html>`, reasonBadResponse,
+			"management API bad response for queue 'tasks' (HTTP 200): invalid character '<' looking for beginning of value"},
+	}
+	for _, tt := range tests {
+		ts := managementServer(t, tt.status, tt.body)
+		mc, err := newManagementClient(ts.URL+"//", &brokerOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = mc.queueLength("tasks")
+		ts.Close()
+		if err == nil {
+			t.Fatal("Expected error")
+		}
+		if got, want := errorReason(err), tt.reason; got != want {
+			t.Errorf("Expected reason='%s', got: '%s'", want, got)
+		}
+		if got, want := err.Error(), tt.msg; got != want {
+			t.Errorf("Expected error='%s', got: '%s'", want, got)
+		}
+	}
+}
+
+func TestManagementClientTimeout(t *testing.T) {
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	mc, err := newManagementClient(ts.URL+"//", &brokerOptions{Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = mc.queueLength("tasks")
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+	if got, want := errorReason(err), reasonUnavailable; got != want {
+		t.Errorf("Expected reason='%s', got: '%s'", want, got)
+	}
+}
+
+func TestStatusReason(t *testing.T) {
+	for status, want := range map[int]string{
+		200: "",
+		204: "",
+		400: reasonBadResponse,
+		401: reasonAuth,
+		403: reasonAuth,
+		404: reasonNotFound,
+		500: reasonUnavailable,
+		502: reasonUnavailable,
+	} {
+		if got := statusReason(status); got != want {
+			t.Errorf("Expected reason='%s' for %d, got: '%s'", want, status, got)
+		}
+	}
+}
+
+func TestManagementClientQueueLengthsPaged(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.URL.EscapedPath(), "/api/queues/%2F"; got != want {
+			t.Errorf("Expected path='%s', got: '%s'", want, got)
+		}
+		q := r.URL.Query()
+		if got, want := q.Get("columns"), "name,messages,head_message_timestamp"; got != want {
+			t.Errorf("Expected columns='%s', got: '%s'", want, got)
+		}
+		if got, want := q.Get("name"), `^(tasks|tasks\.retry)$`; got != want {
+			t.Errorf("Expected name filter='%s', got: '%s'", want, got)
+		}
+		switch q.Get("page") {
+		case "1":
+			w.Write([]byte(`{"items": [{"name": "tasks", "messages": 5}], "page": 1, "page_count": 2}`))
+		case "2":
+			w.Write([]byte(`{"items": [{"name": "tasks.retry", "messages": 2}], "page": 2, "page_count": 2}`))
+		default:
+			t.Errorf("Unexpected page '%s'", q.Get("page"))
+		}
+	}))
+	defer ts.Close()
+
+	mc, err := newManagementClient(ts.URL+"//", &brokerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples, err := mc.queueSamples([]string{"tasks", "tasks.retry"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(samples), 2; got != want {
+		t.Fatalf("Expected %d queues, got: %d", want, got)
+	}
+	if got, want := samples["tasks.retry"].Messages, 2; got != want {
+		t.Errorf("Expected length=%d, got: %d", want, got)
+	}
+}
+
+func TestManagementClientQueueLengthsNoPagination(t *testing.T) {
+	ts := managementServer(t, http.StatusOK, `[{"name": "tasks", "messages": 5}, {"name": "other", "messages": 9}]`)
+	defer ts.Close()
+
+	mc, err := newManagementClient(ts.URL+"//", &brokerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples, err := mc.queueSamples([]string{"tasks", "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(samples), 1; got != want {
+		t.Fatalf("Expected %d queues, got: %d", want, got)
+	}
+	if got, want := samples["tasks"].Messages, 5; got != want {
+		t.Errorf("Expected length=%d, got: %d", want, got)
+	}
+}
+
+func TestManagementClientHeadMessageTimestamp(t *testing.T) {
+	ts := managementServer(t, http.StatusOK, `{"name": "tasks", "messages": 3, "head_message_timestamp": 1500000000}`)
+	defer ts.Close()
+
+	mc, err := newManagementClient(ts.URL+"//", &brokerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sample := mc.queueSample("tasks")
+	if sample.Err != nil {
+		t.Fatal(sample.Err)
+	}
+	if got, want := sample.HeadTimestamp, time.Unix(1500000000, 0); !got.Equal(want) {
+		t.Errorf("Expected timestamp='%v', got: '%v'", want, got)
+	}
+	if got, want := sample.age(time.Unix(1500000090, 0)), 90.0; got != want {
+		t.Errorf("Expected age=%v, got: %v", want, got)
+	}
+}
+
+func TestManagementClientNoHeadMessageTimestamp(t *testing.T) {
+	for _, body := range []string{
+		`{"name": "tasks", "messages": 3}`,
+		`{"name": "tasks", "messages": 3, "head_message_timestamp": ""}`,
+		`{"name": "tasks", "messages": 3, "head_message_timestamp": null}`,
+	} {
+		ts := managementServer(t, http.StatusOK, body)
+		mc, err := newManagementClient(ts.URL+"//", &brokerOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sample := mc.queueSample("tasks")
+		ts.Close()
+		if sample.Err != nil {
+			t.Fatal(sample.Err)
+		}
+		if got, want := sample.age(time.Now()), unknownAge; got != want {
+			t.Errorf("Expected age=%v, got: %v", want, got)
+		}
+	}
+}
@@ -13,14 +13,48 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 type queueMetrics struct {
-	Count    int
-	Average  float64
-	Coverage float64
+	Count    int     `json:"count"`
+	Average  float64 `json:"average"`
+	Coverage float64 `json:"coverage"`
+	// OldestAge is average age of the oldest message in seconds,
+	// negative when unknown
+	OldestAge float64 `json:"oldestAge"`
+
+	// Other aggregations of queue length over the window
+	Max          float64 `json:"max"`
+	P50          float64 `json:"p50"`
+	P90          float64 `json:"p90"`
+	P99          float64 `json:"p99"`
+	Last         float64 `json:"last"`
+	EWMA         float64 `json:"ewma"`
+	TimeWeighted float64 `json:"timeWeighted"`
+}
+
+// aggregate returns queue length aggregated by the named aggregation
+func (m *queueMetrics) aggregate(name string) float64 {
+	switch name {
+	case aggMax:
+		return m.Max
+	case aggP50:
+		return m.P50
+	case aggP90:
+		return m.P90
+	case aggP99:
+		return m.P99
+	case aggLast:
+		return m.Last
+	case aggEWMA:
+		return m.EWMA
+	case aggTimeWeighted:
+		return m.TimeWeighted
+	}
+	return m.Average
 }
 
 func dbPath(dir string, file string) (string, error) {
@@ -60,77 +94,349 @@ func isValidFile(path string) bool {
 	return false
 }
 
-func connectToDB(path *string) (*sql.DB, error) {
-	return sql.Open("sqlite3", *path)
+// connectToDB opens sqlite3 database file or PostgreSQL database given
+// `postgres://` URL
+func connectToDB(path *string) (*metricsDB, error) {
+	dialect := dialectOf(*path)
+	db, err := sql.Open(dialect.Driver, *path)
+	if err != nil {
+		return nil, err
+	}
+	if dialect == sqliteDialect {
+		// every connection to `:memory:` opens a new database
+		db.SetMaxOpenConns(1)
+	}
+	return &metricsDB{DB: db, dialect: dialect}, nil
+}
+
+// sampleSeries identifies samples of an autoscaled resource and the queues
+// measuring its load
+type sampleSeries struct {
+	// Target is the autoscaled resource, e.g. `default/Deployment/worker`
+	Target string
+	// Queue is the queue name or comma separated list of queues, samples
+	// of the list are the series of its queues summed
+	Queue string
 }
 
-func createTable(db *sql.DB) error {
-	stmt, err := db.Prepare(createTableSQL)
+// queues returns names of the queues of the series
+func (s sampleSeries) queues() []string {
+	return strings.Split(s.Queue, ",")
+}
+
+// Names of the metrics recorded for a series
+const (
+	metricMessages  = "messages"
+	metricOldestAge = "oldest_age"
+)
+
+// migration upgrades the database schema to Version, legacy is the series
+// taking over samples recorded before series existed
+type migration struct {
+	Version     int
+	Description string
+	Up          func(tx *metricsTx, legacy sampleSeries) error
+}
+
+// migrations are applied in order, a migration must never change once
+// released, add a new one instead
+var migrations = []migration{
+	// the timeline only ever existed in sqlite3 databases
+	{1, "create timeline", func(tx *metricsTx, legacy sampleSeries) error {
+		if tx.dialect != sqliteDialect {
+			return nil
+		}
+		_, err := tx.Exec(createTimelineSQL)
+		return err
+	}},
+	{2, "add oldest message age to timeline", func(tx *metricsTx, legacy sampleSeries) error {
+		if tx.dialect != sqliteDialect {
+			return nil
+		}
+		return addAgeColumn(tx)
+	}},
+	{3, "replace timeline with multi-series samples", func(tx *metricsTx, legacy sampleSeries) error {
+		for _, stmt := range []string{createSamplesSQL, createSamplesIndexSQL} {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		if tx.dialect != sqliteDialect {
+			return nil
+		}
+		if _, err := tx.Exec(fmt.Sprintf(copyTimelineSQL, "q_len"), legacy.Target, legacy.Queue, metricMessages); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(fmt.Sprintf(copyTimelineSQL, "oldest_age"), legacy.Target, legacy.Queue, metricOldestAge); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`DROP TABLE timeline`)
+		return err
+	}},
+	{4, "create decisions", func(tx *metricsTx, legacy sampleSeries) error {
+		for _, stmt := range []string{createDecisionsSQL, createDecisionsIndexSQL} {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	// several queues are read from the series of each queue, their totals
+	// saved before can't be split
+	{5, "drop samples of several queues summed", func(tx *metricsTx, legacy sampleSeries) error {
+		_, err := tx.Exec(`DELETE FROM samples WHERE queue LIKE '%,%'`)
+		return err
+	}},
+}
+
+// migrateSchema applies migrations missing in the database at the time of
+// clk, databases created before schema versioning start from the first
+// migration
+func migrateSchema(clk clock, db *metricsDB, legacy sampleSeries) error {
+	for _, m := range migrations {
+		if err := applyMigration(clk, db, m, legacy); err != nil {
+			return fmt.Errorf("schema migration %d (%s) failed: %v", m.Version, m.Description, err)
+		}
+	}
+	return nil
+}
+
+// applyMigration applies m unless the database has it already, the
+// migrations table is created and read holding the lock so concurrent
+// autoscalers wait for each other from the start
+func applyMigration(clk clock, db *metricsDB, m migration, legacy sampleSeries) error {
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
-	_, err = stmt.Exec()
+	if len(db.dialect.LockSQL) > 0 {
+		if _, err := tx.Exec(db.dialect.LockSQL); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.Exec(createMigrationsSQL); err != nil {
+		tx.Rollback()
+		return err
+	}
+	// another autoscaler may have applied it while waiting for the lock
+	var applied int
+	if err := tx.QueryRow(`SELECT COUNT(1) FROM schema_migrations WHERE version = ?`, m.Version).Scan(&applied); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if applied > 0 {
+		return tx.Rollback()
+	}
+	if err := m.Up(tx, legacy); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (version, description, applied_ms) VALUES (?, ?, ?)`,
+		m.Version, m.Description, unixMillis(clk.Now())); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// addAgeColumn upgrades timeline tables created before the age of
+// the oldest message was recorded
+func addAgeColumn(tx *metricsTx) error {
+	rows, err := tx.Query(`PRAGMA table_info(timeline)`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == "oldest_age" {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	_, err = tx.Exec(`ALTER TABLE timeline ADD COLUMN oldest_age REAL`)
 	return err
 }
 
-const createTableSQL = `CREATE TABLE IF NOT EXISTS timeline (
+const createMigrationsSQL = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY NOT NULL,
+	description TEXT NOT NULL,
+	applied_ms BIGINT NOT NULL
+)`
+
+const createTimelineSQL = `CREATE TABLE IF NOT EXISTS timeline (
 	unix_secs INTEGER(4) PRIMARY KEY DESC NOT NULL DEFAULT (strftime('%s', 'now')),
 	q_len INTEGER NOT NULL DEFAULT (0)
 )`
 
+const createSamplesSQL = `CREATE TABLE samples (
+	target TEXT NOT NULL,
+	queue TEXT NOT NULL,
+	metric TEXT NOT NULL,
+	ts_ms BIGINT NOT NULL,
+	value DOUBLE PRECISION NOT NULL
+)`
+
+const createSamplesIndexSQL = `CREATE INDEX samples_series ON samples (target, queue, metric, ts_ms)`
+
+const createDecisionsSQL = `CREATE TABLE decisions (
+	target TEXT NOT NULL,
+	ts_ms BIGINT NOT NULL,
+	record TEXT NOT NULL
+)`
+
+const createDecisionsIndexSQL = `CREATE INDEX decisions_target ON decisions (target, ts_ms)`
+
+// copyTimelineSQL copies non-null values of a timeline column into samples
+const copyTimelineSQL = `INSERT INTO samples (target, queue, metric, ts_ms, value)
+SELECT ?, ?, ?, unix_secs * 1000, value FROM (SELECT unix_secs, %s value FROM timeline) WHERE value IS NOT NULL`
+
+// statsQuerySQL selects samples of a time range in chronological order, queue
+// length precedes the age of the oldest message recorded at the same time
 const statsQuerySQL = `SELECT
-	COALESCE(COUNT(1), 0) cnt, COALESCE(AVG(q_len), 0.0) average
+	ts_ms, metric, value, value
 FROM
-	timeline
+	samples
 WHERE
-	strftime('%s', 'now') - unix_secs <= ?`
+	target = ? AND queue = ? AND ts_ms >= ? AND ts_ms <= ?
+ORDER BY
+	ts_ms, metric`
+
+// sumStatsQuerySQL selects samples of several queues like statsQuerySQL,
+// summing lengths of the queues recorded at the same time and taking the
+// oldest of the message ages
+const sumStatsQuerySQL = `SELECT
+	ts_ms, metric, SUM(value), MAX(value)
+FROM
+	samples
+WHERE
+	target = ? AND queue IN (%s) AND ts_ms >= ? AND ts_ms <= ?
+GROUP BY
+	ts_ms, metric
+ORDER BY
+	ts_ms, metric`
+
+const savePointSQL = `INSERT INTO samples (target, queue, metric, ts_ms, value) VALUES (?, ?, ?, ?, ?)`
+const deleteMetricsSQL = `DELETE FROM samples WHERE target = ? AND queue = ? AND ts_ms < ?`
+
+// unixMillis returns milliseconds since epoch
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
 
-const savePointSQL = `INSERT INTO timeline (q_len) VALUES (?)`
-const deleteMetricsSQL = `DELETE FROM timeline WHERE strftime('%s', 'now') - unix_secs > ?`
+// windowStart returns the timestamp in milliseconds of the oldest sample
+// within duration seconds
+func windowStart(now time.Time, duration int) int64 {
+	return unixMillis(now) - int64(duration)*1000
+}
 
-func updateMetrics(db *sql.DB, count, duration int) error {
-	if err := deleteMetrics(db, duration); err != nil {
+func updateMetrics(db *metricsDB, series sampleSeries, now time.Time, count int, age float64, duration int) error {
+	if err := deleteMetrics(db, series, now, duration); err != nil {
 		return err
 	}
-	if err := saveMetric(db, count); err != nil {
+	if err := saveMetric(db, series, now, count, age); err != nil {
 		return err
 	}
 	return nil
 }
 
-func deleteMetrics(db *sql.DB, duration int) error {
+// deleteMetrics removes samples of the series older than the evaluation
+// window, the database keeps no more history than the memory store
+func deleteMetrics(db *metricsDB, series sampleSeries, now time.Time, duration int) error {
 	stmt, err := db.Prepare(deleteMetricsSQL)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(duration)
+	_, err = stmt.Exec(series.Target, series.Queue, windowStart(now, duration))
 	return err
 }
 
-func saveMetric(db *sql.DB, count int) error {
-	stmt, err := db.Prepare(savePointSQL)
+func saveMetric(db *metricsDB, series sampleSeries, now time.Time, count int, age float64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(savePointSQL)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(count)
-	return err
+	ts := unixMillis(now)
+	if _, err = stmt.Exec(series.Target, series.Queue, metricMessages, ts, count); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if age >= 0 {
+		if _, err = stmt.Exec(series.Target, series.Queue, metricOldestAge, ts, age); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-// getMetrics returns number of metrics, average queue length over specified
-// period of time (in seconds)
-func getMetrics(db *sql.DB, duration, interval int) (*queueMetrics, error) {
-	stmt, err := db.Prepare(statsQuerySQL)
+// getMetrics returns number of metrics, aggregated queue length and age of
+// the oldest message over specified period of time (in seconds) until now
+func getMetrics(db *metricsDB, series sampleSeries, now time.Time, duration, interval int) (*queueMetrics, error) {
+	samples, err := getSamples(db, series, windowStart(now, duration), unixMillis(now))
+	if err != nil {
+		return nil, err
+	}
+	return windowStats(samples, unixMillis(now), duration, interval), nil
+}
+
+// getSamples returns samples of the series recorded from and to the
+// milliseconds since epoch in chronological order
+func getSamples(db *metricsDB, series sampleSeries, from, to int64) ([]storedSample, error) {
+	query := statsQuerySQL
+	args := []interface{}{series.Target}
+	if queues := series.queues(); len(queues) > 1 {
+		query = fmt.Sprintf(sumStatsQuerySQL, strings.TrimSuffix(strings.Repeat("?, ", len(queues)), ", "))
+		for _, queue := range queues {
+			args = append(args, queue)
+		}
+	} else {
+		args = append(args, series.Queue)
+	}
+	args = append(args, from, to)
+	stmt, err := db.Prepare(query)
 	if err != nil {
 		return nil, err
 	}
 	defer stmt.Close()
-	row := stmt.QueryRow(duration)
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	metrics := queueMetrics{}
-	row.Scan(&metrics.Count, &metrics.Average)
-	metrics.Coverage = float64(metrics.Count) * float64(interval) / float64(duration)
-	return &metrics, nil
+	var samples []storedSample
+	for rows.Next() {
+		var ts int64
+		var metric string
+		var sum, max float64
+		if err := rows.Scan(&ts, &metric, &sum, &max); err != nil {
+			return nil, err
+		}
+		switch metric {
+		case metricMessages:
+			samples = append(samples, storedSample{UnixMillis: ts, Count: int(sum), Age: unknownAge})
+		case metricOldestAge:
+			if n := len(samples); n > 0 && samples[n-1].UnixMillis == ts {
+				samples[n-1].Age = max
+			}
+		}
+	}
+	return samples, rows.Err()
 }
@@ -62,17 +62,26 @@ func TestDbPathNewFile(t *testing.T) {
 	}
 }
 
-func TestCreateTable(t *testing.T) {
+var testSeries = sampleSeries{Target: "default/Deployment/worker", Queue: "tasks"}
+
+func TestMigrateSchema(t *testing.T) {
 	testDBFile := ":memory:"
 	db, err := connectToDB(&testDBFile)
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = createTable(db)
+	err = migrateSchema(realClock{}, db, testSeries)
 	if err != nil {
 		t.Fatal(err)
 	}
-	stmt, err := db.Prepare(`SELECT unix_secs, q_len FROM timeline`)
+	var version int
+	if err := db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := version, len(migrations); got != want {
+		t.Errorf("Expected schema version='%v', got: '%v'", want, got)
+	}
+	stmt, err := db.Prepare(`SELECT target, queue, metric, ts_ms, value FROM samples`)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -88,23 +97,135 @@ func TestCreateTable(t *testing.T) {
 	}
 }
 
+func TestMigrateSchemaUpgrade(t *testing.T) {
+	testDBFile := ":memory:"
+	db, err := connectToDB(&testDBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// timeline created by earlier versions
+	_, err = db.Exec(`CREATE TABLE timeline (
+	unix_secs INTEGER(4) PRIMARY KEY DESC NOT NULL DEFAULT (strftime('%s', 'now')),
+	q_len INTEGER NOT NULL DEFAULT (0),
+	oldest_age REAL
+)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1500000000, 0)
+	if _, err = db.Exec(`INSERT INTO timeline (unix_secs, q_len, oldest_age) VALUES (?, 4, 12.5), (?, 6, NULL)`, now.Unix()-1, now.Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if err = migrateSchema(newFakeClock(now), db, testSeries); err != nil {
+		t.Fatal(err)
+	}
+	// second run finds the schema up to date
+	if err = migrateSchema(newFakeClock(now.Add(time.Hour)), db, testSeries); err != nil {
+		t.Fatal(err)
+	}
+	var applied int64
+	if err = db.QueryRow(`SELECT MAX(applied_ms) FROM schema_migrations`).Scan(&applied); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := applied, unixMillis(now); got != want {
+		t.Errorf("Expected applied='%v', got: '%v'", want, got)
+	}
+	stats, err := getMetrics(db, testSeries, now, 10, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stats.Count, 2; got != want {
+		t.Errorf("Expected count='%v', got: '%v'", want, got)
+	}
+	if got, want := stats.Average, 5.0; got != want {
+		t.Errorf("Expected average='%v', got: '%v'", want, got)
+	}
+	if got, want := stats.OldestAge, 12.5; got != want {
+		t.Errorf("Expected oldest age='%v', got: '%v'", want, got)
+	}
+	if _, err := db.Exec(`SELECT 1 FROM timeline`); err == nil {
+		t.Error("Expected timeline to be dropped")
+	}
+}
+
+func TestMigrateSchemaUpgradeQueues(t *testing.T) {
+	testDBFile := ":memory:"
+	db, err := connectToDB(&testDBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`CREATE TABLE timeline (
+	unix_secs INTEGER(4) PRIMARY KEY DESC NOT NULL DEFAULT (strftime('%s', 'now')),
+	q_len INTEGER NOT NULL DEFAULT (0)
+)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec(`INSERT INTO timeline (q_len) VALUES (3)`); err != nil {
+		t.Fatal(err)
+	}
+	// totals of the queues can't be split into their series
+	if err = migrateSchema(realClock{}, db, sampleSeries{Target: "default/Deployment/worker", Queue: "a,b"}); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(1) FROM samples`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := count, 0; got != want {
+		t.Errorf("Expected samples='%v', got: '%v'", want, got)
+	}
+}
+
+func TestMigrateSchemaUpgradeWithoutAge(t *testing.T) {
+	testDBFile := ":memory:"
+	db, err := connectToDB(&testDBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`CREATE TABLE timeline (
+	unix_secs INTEGER(4) PRIMARY KEY DESC NOT NULL DEFAULT (strftime('%s', 'now')),
+	q_len INTEGER NOT NULL DEFAULT (0)
+)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec(`INSERT INTO timeline (q_len) VALUES (3)`); err != nil {
+		t.Fatal(err)
+	}
+	if err = migrateSchema(realClock{}, db, testSeries); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := getMetrics(db, testSeries, time.Now(), 10, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stats.Count, 1; got != want {
+		t.Errorf("Expected count='%v', got: '%v'", want, got)
+	}
+	if got, want := stats.OldestAge, unknownAge; got != want {
+		t.Errorf("Expected oldest age='%v', got: '%v'", want, got)
+	}
+}
+
 func TestUpdateMetrics(t *testing.T) {
 	testDBFile := ":memory:"
 	db, err := connectToDB(&testDBFile)
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = createTable(db)
+	err = migrateSchema(realClock{}, db, testSeries)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	duration := 2
+	clk := newFakeClock(time.Unix(1500000000, 0))
 	for i := 0; i < 30; i++ {
-		updateMetrics(db, i, duration)
-		time.Sleep(100 * time.Millisecond)
+		updateMetrics(db, testSeries, clk.Now(), i, unknownAge, duration)
+		clk.Advance(100 * time.Millisecond)
 	}
-	stmt, err := db.Prepare(`SELECT MIN(unix_secs) FROM timeline`)
+	stmt, err := db.Prepare(`SELECT MIN(ts_ms) FROM samples`)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -113,26 +234,59 @@ func TestUpdateMetrics(t *testing.T) {
 	var minTime int64
 	row.Scan(&minTime)
 
-	if got, want := minTime, time.Now().Unix(); got+int64(duration) > want {
+	// the last sample was saved at 2.9s, samples since 0.9s are kept
+	if got, want := minTime, unixMillis(time.Unix(1500000000, 0).Add(900*time.Millisecond)); got != want {
 		t.Errorf("Expected min date='%v', got: '%v'", want, got)
 	}
 }
 
+func TestUpdateMetricsSameSecond(t *testing.T) {
+	testDBFile := ":memory:"
+	db, err := connectToDB(&testDBFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = migrateSchema(realClock{}, db, testSeries); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1500000000, 0)
+	for i := 0; i < 3; i++ {
+		if err := updateMetrics(db, testSeries, now, i, unknownAge, 60); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// samples of other series are not counted
+	if err := updateMetrics(db, sampleSeries{Target: "default/Deployment/other", Queue: "tasks"}, now, 100, unknownAge, 60); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := getMetrics(db, testSeries, now, 60, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stats.Count, 3; got != want {
+		t.Errorf("Expected count='%v', got: '%v'", want, got)
+	}
+	if got, want := stats.Average, 1.0; got != want {
+		t.Errorf("Expected average='%v', got: '%v'", want, got)
+	}
+}
+
 func TestGetMetrics(t *testing.T) {
 	testDBFile := ":memory:"
 	db, err := connectToDB(&testDBFile)
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = createTable(db)
+	err = migrateSchema(realClock{}, db, testSeries)
 	if err != nil {
 		t.Fatal(err)
 	}
+	clk := newFakeClock(time.Unix(1500000000, 0))
 	for i := 0; i < 3; i++ {
-		updateMetrics(db, i, 6)
-		time.Sleep(1 * time.Second)
+		updateMetrics(db, testSeries, clk.Now(), i, float64(i*10), 6)
+		clk.Advance(time.Second)
 	}
-	stats, err := getMetrics(db, 6, 1)
+	stats, err := getMetrics(db, testSeries, clk.Now(), 6, 1)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -145,5 +299,8 @@ func TestGetMetrics(t *testing.T) {
 	if got, want := stats.Coverage, 0.5; got != want {
 		t.Errorf("Expected coverage='%v', got: '%v'", want, got)
 	}
+	if got, want := stats.OldestAge, 10.0; got != want {
+		t.Errorf("Expected oldest age='%v', got: '%v'", want, got)
+	}
 
 }
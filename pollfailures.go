@@ -0,0 +1,115 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Strategies for queues which failed to poll while others succeeded
+const (
+	// failSample discards the whole sample, no statistics are saved
+	failSample = "fail"
+	// skipQueue sums over the queues polled successfully
+	skipQueue = "skip"
+	// lastKnown reuses the last value retrieved for the queue
+	lastKnown = "last-known"
+)
+
+var (
+	queuePollFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "queue_poll_failures_total",
+			Help:      "Number of failed queue polls by queue and reason.",
+		},
+		[]string{"queue", "reason"},
+	)
+)
+
+// knownSample is the last successful sample of a queue
+type knownSample struct {
+	Sample queueSample
+	At     time.Time
+}
+
+// failurePolicy decides what to do with queues that failed to poll,
+// the sample fails when all queues failed regardless of the strategy
+type failurePolicy struct {
+	Strategy string
+	// MaxAge limits how long a last known value can be reused
+	MaxAge time.Duration
+	// Clock is the system clock when not set
+	Clock clock
+
+	last map[string]knownSample
+}
+
+// poll wraps fpoll, failed samples are replaced or removed according to
+// the strategy, the remaining ones fail the whole sample
+func (fp *failurePolicy) poll(fpoll queuePoll) queuePoll {
+	return func(names []string) []queueSample {
+		now := fp.now()
+		samples := fpoll(names)
+		fp.remember(samples, now)
+		failed := 0
+		for _, sample := range samples {
+			if sample.Err != nil {
+				failed++
+				queuePollFailures.With(prometheus.Labels{"queue": sample.Name, "reason": errorReason(sample.Err)}).Inc()
+			}
+		}
+		if failed == 0 || failed == len(samples) || fp.Strategy == failSample {
+			return samples
+		}
+
+		resolved := make([]queueSample, 0, len(samples))
+		for _, sample := range samples {
+			if sample.Err == nil {
+				resolved = append(resolved, sample)
+				continue
+			}
+			switch fp.Strategy {
+			case skipQueue:
+				log.Printf("Skipping queue %s: %v", sample.Name, sample.Err)
+				continue
+			case lastKnown:
+				if known, ok := fp.last[sample.Name]; ok && now.Sub(known.At) <= fp.MaxAge {
+					log.Printf("Using length of queue %s retrieved %v ago: %v",
+						sample.Name, now.Sub(known.At).Truncate(time.Second), sample.Err)
+					resolved = append(resolved, known.Sample)
+					continue
+				}
+			}
+			resolved = append(resolved, sample)
+		}
+		return resolved
+	}
+}
+
+func (fp *failurePolicy) now() time.Time {
+	if fp.Clock == nil {
+		return time.Now()
+	}
+	return fp.Clock.Now()
+}
+
+func (fp *failurePolicy) remember(samples []queueSample, now time.Time) {
+	if fp.Strategy != lastKnown {
+		return
+	}
+	if fp.last == nil {
+		fp.last = make(map[string]knownSample)
+	}
+	for _, sample := range samples {
+		if sample.Err == nil {
+			fp.last[sample.Name] = knownSample{Sample: sample, At: now}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/streadway/amqp"
+)
+
+// fixedPoll returns the samples set on it, in the order of the names
+type fixedPoll map[string]queueSample
+
+func (p fixedPoll) poll(names []string) []queueSample {
+	samples := make([]queueSample, len(names))
+	for i, name := range names {
+		samples[i] = p[name]
+		samples[i].Name = name
+	}
+	return samples
+}
+
+func TestFailurePolicyFail(t *testing.T) {
+	src := fixedPoll{"a": {Messages: 3}, "b": {Err: errors.New("boom")}}
+	fp := &failurePolicy{Strategy: failSample}
+
+	samples := fp.poll(src.poll)([]string{"a", "b"})
+	if got, want := len(samples), 2; got != want {
+		t.Fatalf("Expected %d samples, got: %d", want, got)
+	}
+	if samples[1].Err == nil {
+		t.Fatal("Expected error")
+	}
+}
+
+func TestFailurePolicySkip(t *testing.T) {
+	src := fixedPoll{"a": {Messages: 3}, "b": {Err: &amqp.Error{Code: amqp.NotFound}}}
+	fp := &failurePolicy{Strategy: skipQueue}
+	before := testutil.ToFloat64(queuePollFailures.WithLabelValues("b", reasonNotFound))
+
+	samples := fp.poll(src.poll)([]string{"a", "b"})
+	if got, want := len(samples), 1; got != want {
+		t.Fatalf("Expected %d samples, got: %d", want, got)
+	}
+	if got, want := samples[0].Name, "a"; got != want {
+		t.Errorf("Expected queue='%s', got: '%s'", want, got)
+	}
+	if got, want := testutil.ToFloat64(queuePollFailures.WithLabelValues("b", reasonNotFound))-before, 1.0; got != want {
+		t.Errorf("Expected failures=%v, got: %v", want, got)
+	}
+}
+
+func TestFailurePolicySkipAllFailed(t *testing.T) {
+	src := fixedPoll{"a": {Err: errors.New("boom")}, "b": {Err: errors.New("boom")}}
+	fp := &failurePolicy{Strategy: skipQueue}
+
+	samples := fp.poll(src.poll)([]string{"a", "b"})
+	if got, want := len(samples), 2; got != want {
+		t.Fatalf("Expected %d samples, got: %d", want, got)
+	}
+	if samples[0].Err == nil || samples[1].Err == nil {
+		t.Fatal("Expected errors")
+	}
+}
+
+func TestFailurePolicyLastKnown(t *testing.T) {
+	src := fixedPoll{"a": {Messages: 3}, "b": {Messages: 5}}
+	clk := newFakeClock(time.Unix(1500000000, 0))
+	fp := &failurePolicy{Strategy: lastKnown, MaxAge: time.Minute, Clock: clk}
+	fpoll := fp.poll(src.poll)
+	fpoll([]string{"a", "b"})
+
+	src["b"] = queueSample{Err: errors.New("boom")}
+	samples := fpoll([]string{"a", "b"})
+	if samples[1].Err != nil {
+		t.Fatal(samples[1].Err)
+	}
+	if got, want := samples[1].Messages, 5; got != want {
+		t.Errorf("Expected %d, got: %d", want, got)
+	}
+
+	// stale value isn't reused
+	clk.Advance(2 * time.Minute)
+	samples = fpoll([]string{"a", "b"})
+	if samples[1].Err == nil {
+		t.Fatal("Expected error")
+	}
+}
+
+func TestErrorReason(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&managementError{Reason: reasonBadResponse}, reasonBadResponse},
+		{&amqp.Error{Code: amqp.NotFound}, reasonNotFound},
+		{amqp.ErrCredentials, reasonAuth},
+		{&amqp.Error{Code: amqp.ConnectionForced}, reasonUnavailable},
+		{errors.New("boom"), "error"},
+	}
+	for _, tt := range tests {
+		if got := errorReason(tt.err); got != tt.want {
+			t.Errorf("Expected reason='%s' for '%v', got: '%s'", tt.want, tt.err, got)
+		}
+	}
+}
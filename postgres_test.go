@@ -0,0 +1,105 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+// +build integration
+
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// postgresDB connects to an empty PostgreSQL database given by POSTGRES_URI,
+// the test is skipped when not set
+func postgresDB(t *testing.T) *metricsDB {
+	uri := os.Getenv("POSTGRES_URI")
+	if len(uri) == 0 {
+		t.Skip("POSTGRES_URI is not set")
+	}
+	db, err := connectToDB(&uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{"samples", "decisions", "schema_migrations"} {
+		if _, err := db.Exec(`DROP TABLE IF EXISTS ` + table); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestPostgresMigrateSchema(t *testing.T) {
+	db := postgresDB(t)
+	defer db.Close()
+
+	if err := migrateSchema(realClock{}, db, testSeries); err != nil {
+		t.Fatal(err)
+	}
+	// second run finds the schema up to date
+	if err := migrateSchema(realClock{}, db, testSeries); err != nil {
+		t.Fatal(err)
+	}
+	var version int
+	if err := db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := version, len(migrations); got != want {
+		t.Errorf("Expected schema version='%v', got: '%v'", want, got)
+	}
+}
+
+func TestPostgresMigrateSchemaConcurrently(t *testing.T) {
+	db := postgresDB(t)
+	defer db.Close()
+
+	// replicas starting at the same time on an empty database
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() { errs <- migrateSchema(realClock{}, db, testSeries) }()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(1) FROM schema_migrations`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := count, len(migrations); got != want {
+		t.Errorf("Expected applied migrations='%v', got: '%v'", want, got)
+	}
+}
+
+func TestPostgresGetMetrics(t *testing.T) {
+	db := postgresDB(t)
+	defer db.Close()
+	if err := migrateSchema(realClock{}, db, testSeries); err != nil {
+		t.Fatal(err)
+	}
+
+	clk := newFakeClock(time.Unix(1500000000, 0))
+	for i := 0; i < 3; i++ {
+		if err := updateMetrics(db, testSeries, clk.Now(), i, float64(i*10), 6); err != nil {
+			t.Fatal(err)
+		}
+		clk.Advance(time.Second)
+	}
+	stats, err := getMetrics(db, testSeries, clk.Now(), 6, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stats.Count, 3; got != want {
+		t.Errorf("Expected count='%v', got: '%v'", want, got)
+	}
+	if got, want := stats.Average, 1.0; got != want {
+		t.Errorf("Expected average='%v', got: '%v'", want, got)
+	}
+	if got, want := stats.OldestAge, 10.0; got != want {
+		t.Errorf("Expected oldest age='%v', got: '%v'", want, got)
+	}
+}
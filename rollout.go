@@ -0,0 +1,90 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	appsv1 "k8s.io/api/apps/v1"
+)
+
+// Scaling held while a rollout of the deployment is in progress
+const (
+	// holdNone scales regardless of rollouts
+	holdNone = "none"
+	// holdScaleDown holds decreasing the replicas only
+	holdScaleDown = "scale-down"
+	// holdAll holds any change of the replicas
+	holdAll = "all"
+)
+
+// Reasons of a rollout not being complete
+const (
+	rolloutPaused        = "paused"
+	rolloutGenerationLag = "generation-lag"
+	rolloutProgressing   = "progressing"
+)
+
+// rolloutReasons lists reasons of a rollout not being complete
+var rolloutReasons = []string{rolloutPaused, rolloutGenerationLag, rolloutProgressing}
+
+var (
+	rolloutHold = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "rollout_hold",
+			Help:      "Whether scaling is held by a rollout of the deployment in progress, by reason.",
+		},
+		[]string{"reason"},
+	)
+)
+
+// rolloutStatus returns why the rollout of the deployment is not complete,
+// empty when it is; a rollout past its progress deadline is considered
+// complete so it doesn't hold scaling indefinitely
+func rolloutStatus(d *appsv1.Deployment) string {
+	if d.Spec.Paused {
+		return rolloutPaused
+	}
+	if d.Status.ObservedGeneration < d.Generation {
+		return rolloutGenerationLag
+	}
+	for _, c := range d.Status.Conditions {
+		if c.Type == appsv1.DeploymentProgressing && c.Reason == "ProgressDeadlineExceeded" {
+			return ""
+		}
+	}
+	if d.Spec.Replicas != nil && d.Status.UpdatedReplicas < *d.Spec.Replicas {
+		return rolloutProgressing
+	}
+	if d.Status.Replicas > d.Status.UpdatedReplicas || d.Status.AvailableReplicas < d.Status.UpdatedReplicas {
+		return rolloutProgressing
+	}
+	return ""
+}
+
+// holds reports whether scaling from current to replicas is held by the
+// hold mode during a rollout
+func holds(mode string, current, replicas int32) bool {
+	switch mode {
+	case holdAll:
+		return replicas != current
+	case holdScaleDown:
+		return replicas < current
+	}
+	return false
+}
+
+// setRolloutHold exports the reason of holding scaling, empty when scaling
+// is not held
+func setRolloutHold(reason string) {
+	for _, r := range rolloutReasons {
+		value := 0.0
+		if r == reason {
+			value = 1
+		}
+		rolloutHold.With(prometheus.Labels{"reason": r}).Set(value)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// testDeployment returns deployment of replicas with the rollout complete
+func testDeployment(replicas int32) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: v1.ObjectMeta{Name: "worker", Namespace: "jobs", Generation: 2},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+		Status: appsv1.DeploymentStatus{ObservedGeneration: 2,
+			Replicas:          replicas,
+			UpdatedReplicas:   replicas,
+			AvailableReplicas: replicas},
+	}
+}
+
+func TestRolloutStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(d *appsv1.Deployment)
+		want   string
+	}{
+		{"complete", func(d *appsv1.Deployment) {}, ""},
+		{"paused", func(d *appsv1.Deployment) { d.Spec.Paused = true }, rolloutPaused},
+		{"generation lag", func(d *appsv1.Deployment) { d.Generation = 3 }, rolloutGenerationLag},
+		{"not updated", func(d *appsv1.Deployment) { d.Status.UpdatedReplicas = 1 }, rolloutProgressing},
+		{"old replicas", func(d *appsv1.Deployment) { d.Status.Replicas = 5 }, rolloutProgressing},
+		{"not available", func(d *appsv1.Deployment) { d.Status.AvailableReplicas = 2 }, rolloutProgressing},
+		{"deadline exceeded", func(d *appsv1.Deployment) {
+			d.Status.UpdatedReplicas = 1
+			d.Status.Conditions = []appsv1.DeploymentCondition{{Type: appsv1.DeploymentProgressing, Reason: "ProgressDeadlineExceeded"}}
+		}, ""},
+	}
+	for _, tt := range tests {
+		d := testDeployment(3)
+		tt.modify(d)
+		if got := rolloutStatus(d); got != tt.want {
+			t.Errorf("Expected status='%s' when %s, got: '%s'", tt.want, tt.name, got)
+		}
+	}
+}
+
+func TestHolds(t *testing.T) {
+	tests := []struct {
+		mode              string
+		current, replicas int32
+		want              bool
+	}{
+		{holdNone, 4, 2, false},
+		{holdScaleDown, 4, 2, true},
+		{holdScaleDown, 4, 6, false},
+		{holdAll, 4, 6, true},
+		{holdAll, 4, 4, false},
+	}
+	for _, tt := range tests {
+		if got := holds(tt.mode, tt.current, tt.replicas); got != tt.want {
+			t.Errorf("Expected %v for %s from %d to %d, got: %v", tt.want, tt.mode, tt.current, tt.replicas, got)
+		}
+	}
+}
+
+func TestKubeTargetRolloutHold(t *testing.T) {
+	d := testDeployment(4)
+	d.Status.UpdatedReplicas = 2
+	c := newScaleClientset(d)
+	target := startTestTarget(t, c, deploymentKind)
+	target.RolloutHold = holdScaleDown
+
+	// the held decision is not limited by the min bound
+	decision := &scaleDecision{Replicas: 0, OldestAge: unknownAge}
+	if err := target.scale(decision); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := decision.Held, rolloutProgressing; got != want {
+		t.Errorf("Expected held='%s', got: '%s'", want, got)
+	}
+	if got, want := decision.Bound, ""; got != want {
+		t.Errorf("Expected bound='%s', got: '%s'", want, got)
+	}
+	if got, want := decision.Scaled, int32(4); got != want {
+		t.Errorf("Expected scaled=%d, got: %d", want, got)
+	}
+	if got, want := updates(c), 0; got != want {
+		t.Errorf("Expected %d updates, got: %d", want, got)
+	}
+	if got, want := testutil.ToFloat64(rolloutHold.With(prometheus.Labels{"reason": rolloutProgressing})), 1.0; got != want {
+		t.Errorf("Expected rollout hold=%v, got: %v", want, got)
+	}
+	if reasons := eventReasons(t, c); len(reasons) != 1 || reasons[0] != reasonScalingHeld {
+		t.Errorf("Expected %s event, got: %v", reasonScalingHeld, reasons)
+	}
+
+	// scaling up is not held
+	if err := target.scale(&scaleDecision{Replicas: 6, OldestAge: unknownAge}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := updates(c), 1; got != want {
+		t.Errorf("Expected %d updates, got: %d", want, got)
+	}
+	if got, want := testutil.ToFloat64(rolloutHold.With(prometheus.Labels{"reason": rolloutProgressing})), 0.0; got != want {
+		t.Errorf("Expected rollout hold=%v, got: %v", want, got)
+	}
+}
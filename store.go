@@ -0,0 +1,157 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SampleStore keeps queue samples for the evaluation window
+type SampleStore interface {
+	// Add records total number of messages on the queues and age in
+	// seconds of the oldest message, negative when unknown
+	Add(count int, age float64) error
+	// AddAt records the sample at the time now, samples of several queues
+	// added at the same time are summed by a store of the queues
+	AddAt(now time.Time, count int, age float64) error
+	// Stats returns statistics of the samples recorded within duration
+	// seconds, interval is the time between samples in seconds
+	Stats(duration, interval int) (*queueMetrics, error)
+	// Samples returns samples recorded from and to the times in
+	// chronological order
+	Samples(from, to time.Time) ([]storedSample, error)
+	Close() error
+}
+
+// newSampleStore returns SQL store for a sqlite3 database file or
+// PostgreSQL URL, samples are kept in memory when no database is given
+func newSampleStore(clk clock, file string, series sampleSeries, duration, interval int) (SampleStore, error) {
+	if len(file) == 0 {
+		return newMemoryStore(clk, duration, interval), nil
+	}
+	return newSQLStore(clk, file, series, duration)
+}
+
+// memoryStore keeps samples in a ring buffer sized for the evaluation
+// window, the oldest samples are overwritten
+type memoryStore struct {
+	clock   clock
+	mu      sync.Mutex
+	samples []storedSample
+	next    int
+	size    int
+}
+
+func newMemoryStore(clk clock, duration, interval int) *memoryStore {
+	// twice the expected number of samples leaves room for jitter of
+	// the sampling loop
+	capacity := 2 * (duration/interval + 1)
+	return &memoryStore{clock: clk, samples: make([]storedSample, capacity)}
+}
+
+func (s *memoryStore) Add(count int, age float64) error {
+	return s.AddAt(s.clock.Now(), count, age)
+}
+
+func (s *memoryStore) AddAt(now time.Time, count int, age float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samples[s.next] = storedSample{UnixMillis: unixMillis(now), Count: count, Age: age}
+	s.next = (s.next + 1) % len(s.samples)
+	if s.size < len(s.samples) {
+		s.size++
+	}
+	return nil
+}
+
+func (s *memoryStore) Stats(duration, interval int) (*queueMetrics, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock.Now()
+	from := windowStart(now, duration)
+	samples := make([]storedSample, 0, s.size)
+	// the oldest sample is at next when the buffer is full
+	for i := 0; i < s.size; i++ {
+		sample := s.samples[(s.next-s.size+i+len(s.samples))%len(s.samples)]
+		if sample.UnixMillis >= from {
+			samples = append(samples, sample)
+		}
+	}
+	return windowStats(samples, unixMillis(now), duration, interval), nil
+}
+
+func (s *memoryStore) Samples(from, to time.Time) ([]storedSample, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	start, end := unixMillis(from), unixMillis(to)
+	var samples []storedSample
+	for i := 0; i < s.size; i++ {
+		sample := s.samples[(s.next-s.size+i+len(s.samples))%len(s.samples)]
+		if sample.UnixMillis >= start && sample.UnixMillis <= end {
+			samples = append(samples, sample)
+		}
+	}
+	return samples, nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// sqlStore keeps samples of a series in SQL database, samples survive
+// restarts when the database is a file or PostgreSQL, which can also be
+// shared by autoscaler replicas; a store of several queues reads their
+// series summed
+type sqlStore struct {
+	clock    clock
+	db       *metricsDB
+	series   sampleSeries
+	duration int
+	// shared stores use the database of another store, which closes it
+	shared bool
+}
+
+func newSQLStore(clk clock, file string, series sampleSeries, duration int) (*sqlStore, error) {
+	db, err := connectToDB(&file)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateSchema(clk, db, series); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlStore{clock: clk, db: db, series: series, duration: duration}, nil
+}
+
+func (s *sqlStore) Add(count int, age float64) error {
+	return s.AddAt(s.clock.Now(), count, age)
+}
+
+// AddAt fails for a series of several queues, their samples are added
+// to the series of each queue and summed when read
+func (s *sqlStore) AddAt(now time.Time, count int, age float64) error {
+	if len(s.series.queues()) > 1 {
+		return fmt.Errorf("samples of queues '%s' are added to the series of each queue", s.series.Queue)
+	}
+	return updateMetrics(s.db, s.series, now, count, age, s.duration)
+}
+
+func (s *sqlStore) Stats(duration, interval int) (*queueMetrics, error) {
+	return getMetrics(s.db, s.series, s.clock.Now(), duration, interval)
+}
+
+func (s *sqlStore) Samples(from, to time.Time) ([]storedSample, error) {
+	return getSamples(s.db, s.series, unixMillis(from), unixMillis(to))
+}
+
+func (s *sqlStore) Close() error {
+	if s.shared {
+		return nil
+	}
+	return s.db.Close()
+}
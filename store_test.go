@@ -0,0 +1,221 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNewSampleStore(t *testing.T) {
+	store, err := newSampleStore(realClock{}, "", sampleSeries{}, 60, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.(*memoryStore); !ok {
+		t.Errorf("Expected memory store, got: %T", store)
+	}
+
+	store, err = newSampleStore(realClock{}, ":memory:", sampleSeries{}, 60, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if _, ok := store.(*sqlStore); !ok {
+		t.Errorf("Expected SQL store, got: %T", store)
+	}
+}
+
+func TestMemoryStoreStats(t *testing.T) {
+	store := newMemoryStore(realClock{}, 10, 5)
+	store.Add(2, unknownAge)
+	store.Add(4, 30)
+	store.Add(6, 10)
+
+	stats, err := store.Stats(10, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stats.Count, 3; got != want {
+		t.Errorf("Expected count='%v', got: '%v'", want, got)
+	}
+	if got, want := stats.Average, 4.0; got != want {
+		t.Errorf("Expected average='%v', got: '%v'", want, got)
+	}
+	if got, want := stats.OldestAge, 20.0; got != want {
+		t.Errorf("Expected oldest age='%v', got: '%v'", want, got)
+	}
+	if got, want := stats.Coverage, 1.5; got != want {
+		t.Errorf("Expected coverage='%v', got: '%v'", want, got)
+	}
+}
+
+func TestMemoryStoreEmpty(t *testing.T) {
+	stats, err := newMemoryStore(realClock{}, 10, 5).Stats(10, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stats.Count, 0; got != want {
+		t.Errorf("Expected count='%v', got: '%v'", want, got)
+	}
+	if got, want := stats.OldestAge, unknownAge; got != want {
+		t.Errorf("Expected oldest age='%v', got: '%v'", want, got)
+	}
+}
+
+func TestMemoryStoreWindow(t *testing.T) {
+	clk := newFakeClock(time.Unix(1500000000, 0))
+	store := newMemoryStore(clk, 10, 5)
+	for i := 0; i < len(store.samples)+3; i++ {
+		store.Add(i, unknownAge)
+		clk.Advance(time.Second)
+	}
+	// the buffer keeps the last 6 samples taken at 3..8s, the one
+	// taken at 3s is out of the window ending at 14s
+	clk.Advance(5 * time.Second)
+
+	stats, err := store.Stats(10, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stats.Count, 5; got != want {
+		t.Errorf("Expected count='%v', got: '%v'", want, got)
+	}
+}
+
+func TestStoreSamples(t *testing.T) {
+	clk := newFakeClock(time.Unix(1500000000, 0))
+	sqlite, err := newSQLStore(clk, ":memory:", sampleSeries{Target: "default/Deployment/worker", Queue: "tasks"}, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.Close()
+	stores := []SampleStore{newMemoryStore(clk, 60, 5), sqlite}
+	start := clk.Now()
+	for i := 0; i < 4; i++ {
+		for _, store := range stores {
+			store.Add(i, float64(i))
+		}
+		clk.Advance(5 * time.Second)
+	}
+
+	for _, store := range stores {
+		samples, err := store.Samples(start.Add(5*time.Second), start.Add(10*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(samples), 2; got != want {
+			t.Fatalf("Expected %d samples from %T, got: %d", want, store, got)
+		}
+		if got, want := samples[1], (storedSample{UnixMillis: unixMillis(start) + 10000, Count: 2, Age: 2}); got != want {
+			t.Errorf("Expected sample %+v from %T, got: %+v", want, store, got)
+		}
+	}
+}
+
+func TestSQLStoreQueuesSummed(t *testing.T) {
+	clk := newFakeClock(time.Unix(1500000000, 0))
+	// every connection to `:memory:` opens a new database
+	summed, err := newSQLStore(clk, ":memory:", sampleSeries{Target: "jobs/Deployment/worker", Queue: "a,b"}, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer summed.Close()
+	stores := newQueueStores(clk, summed.db, "jobs/Deployment/worker", []string{"a", "b"}, 20, 5)
+	defer stores.Close()
+
+	start := clk.Now()
+	polls := [][]queueSample{
+		{{Name: "a", Messages: 3, HeadTimestamp: start.Add(-10 * time.Second)}, {Name: "b", Messages: 5}},
+		// skipped by the failure policy
+		{{Name: "a", Messages: 4}},
+		{{Name: "a", Messages: 6}, {Name: "b", Err: errors.New("unavailable")}},
+		{{Name: "a", Messages: 1}, {Name: "b", Messages: 2, HeadTimestamp: start}},
+	}
+	for _, samples := range polls {
+		samples := samples
+		stores.pollTotal(clk, func([]string) []queueSample { return samples })([]string{"a", "b"})
+		clk.Advance(5 * time.Second)
+	}
+
+	// the queues are summed, nothing is saved the time queue b failed
+	samples, err := summed.Samples(start, clk.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []storedSample{{UnixMillis: unixMillis(start), Count: 8, Age: 10},
+		{UnixMillis: unixMillis(start) + 5000, Count: 4, Age: unknownAge},
+		{UnixMillis: unixMillis(start) + 15000, Count: 3, Age: 15}}
+	if got := len(samples); got != len(want) {
+		t.Fatalf("Expected %d samples, got: %d", len(want), got)
+	}
+	for i := range want {
+		if got := samples[i]; got != want[i] {
+			t.Errorf("Expected sample %+v, got: %+v", want[i], got)
+		}
+	}
+	if err := summed.Add(1, unknownAge); err == nil {
+		t.Error("Expected error adding the total of the queues")
+	}
+}
+
+func TestMemoryStoreAddAllocs(t *testing.T) {
+	store := newMemoryStore(realClock{}, 60, 5)
+	allocs := testing.AllocsPerRun(100, func() {
+		store.Add(10, 1.5)
+	})
+	if allocs > 0 {
+		t.Errorf("Expected no allocations, got: %v", allocs)
+	}
+}
+
+func benchmarkStoreAdd(b *testing.B, store SampleStore) {
+	defer store.Close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.Add(i, unknownAge)
+	}
+}
+
+func benchmarkStoreStats(b *testing.B, store SampleStore) {
+	defer store.Close()
+	for i := 0; i < 12; i++ {
+		store.Add(i, float64(i))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.Stats(60, 5); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMemoryStoreAdd(b *testing.B) {
+	benchmarkStoreAdd(b, newMemoryStore(realClock{}, 60, 5))
+}
+
+func BenchmarkSQLiteStoreAdd(b *testing.B) {
+	store, err := newSQLStore(realClock{}, ":memory:", sampleSeries{Target: "default/Deployment/worker", Queue: "tasks"}, 60)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkStoreAdd(b, store)
+}
+
+func BenchmarkMemoryStoreStats(b *testing.B) {
+	benchmarkStoreStats(b, newMemoryStore(realClock{}, 60, 5))
+}
+
+func BenchmarkSQLiteStoreStats(b *testing.B) {
+	store, err := newSQLStore(realClock{}, ":memory:", sampleSeries{Target: "default/Deployment/worker", Queue: "tasks"}, 60)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkStoreStats(b, store)
+}
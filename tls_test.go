@@ -0,0 +1,303 @@
+// Copyright (c) 2016, M Bogus.
+// This source file is part of the KUBE-AMQP-AUTOSCALE open source project
+// Licensed under Apache License v2.0
+// See LICENSE file for license information
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPKI holds file names of a CA, server and client certificates
+// generated for a test
+type testPKI struct {
+	Dir        string
+	CAFile     string
+	ServerCert string
+	ServerKey  string
+	ClientCert string
+	ClientKey  string
+}
+
+func newTestPKI(t *testing.T, serverName string) *testPKI {
+	dir, err := ioutil.TempDir(os.TempDir(), "pki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pki := &testPKI{Dir: dir,
+		CAFile:     filepath.Join(dir, "ca.pem"),
+		ServerCert: filepath.Join(dir, "server.pem"),
+		ServerKey:  filepath.Join(dir, "server-key.pem"),
+		ClientCert: filepath.Join(dir, "client.pem"),
+		ClientKey:  filepath.Join(dir, "client-key.pem"),
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, pki.CAFile, "CERTIFICATE", caDER)
+
+	issue := func(serial int64, cn string, usage x509.ExtKeyUsage, certFile, keyFile string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: cn},
+			DNSNames:     []string{cn},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, cert, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writePEM(t, certFile, "CERTIFICATE", der)
+		writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	}
+	issue(2, serverName, x509.ExtKeyUsageServerAuth, pki.ServerCert, pki.ServerKey)
+	issue(3, "autoscaler", x509.ExtKeyUsageClientAuth, pki.ClientCert, pki.ClientKey)
+
+	return pki
+}
+
+func (pki *testPKI) Remove() {
+	os.RemoveAll(pki.Dir)
+}
+
+func writePEM(t *testing.T, file, blockType string, der []byte) {
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSConfigNoFiles(t *testing.T) {
+	c, err := tlsConfig("", "", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.InsecureSkipVerify, true; got != want {
+		t.Errorf("Expected insecure='%v', got: '%v'", want, got)
+	}
+	if c.RootCAs != nil || len(c.Certificates) > 0 {
+		t.Error("Expected no CA and client certificates")
+	}
+}
+
+func TestTLSConfigMissingKey(t *testing.T) {
+	_, err := tlsConfig("", "client.pem", "", false)
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+	if got, want := err.Error(), "both client certificate and key files are required"; got != want {
+		t.Errorf("Expected error='%s', got: '%s'", want, got)
+	}
+}
+
+func TestTLSConfigInvalidCA(t *testing.T) {
+	file, err := ioutil.TempFile(os.TempDir(), "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("not a certificate")
+	file.Close()
+
+	_, err = tlsConfig(file.Name(), "", "", false)
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+}
+
+// TestDialBrokerTLSExternalAuth runs AMQP connection negotiation against
+// a local TLS listener requiring client certificates, up to the point
+// the client selects SASL mechanism
+func TestDialBrokerTLSExternalAuth(t *testing.T) {
+	pki := newTestPKI(t, "rabbitmq.test")
+	defer pki.Remove()
+
+	serverCert, err := tls.LoadX509KeyPair(pki.ServerCert, pki.ServerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM, err := ioutil.ReadFile(pki.CAFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(caPEM)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	type result struct {
+		Peer      string
+		Mechanism string
+		Err       error
+	}
+	results := make(chan result, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			results <- result{Err: err}
+			return
+		}
+		defer conn.Close()
+		tlsConn := conn.(*tls.Conn)
+		if err := tlsConn.Handshake(); err != nil {
+			results <- result{Err: err}
+			return
+		}
+		peer := tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		mechanism, err := negotiateSASL(conn, "EXTERNAL PLAIN")
+		results <- result{Peer: peer, Mechanism: mechanism, Err: err}
+	}()
+
+	opts := &brokerOptions{CAFile: pki.CAFile,
+		CertFile:     pki.ClientCert,
+		KeyFile:      pki.ClientKey,
+		ServerName:   "rabbitmq.test",
+		ExternalAuth: true,
+		Timeout:      5 * time.Second,
+	}
+	conn, err := dialBroker("amqps://"+ln.Addr().String()+"/", opts)
+	if err == nil {
+		conn.Close()
+	}
+
+	r := <-results
+	if r.Err != nil {
+		t.Fatal(r.Err)
+	}
+	if got, want := r.Peer, "autoscaler"; got != want {
+		t.Errorf("Expected client certificate CN='%s', got: '%s'", want, got)
+	}
+	if got, want := r.Mechanism, "EXTERNAL"; got != want {
+		t.Errorf("Expected SASL mechanism='%s', got: '%s'", want, got)
+	}
+}
+
+func TestDialBrokerTLSUnknownCA(t *testing.T) {
+	pki := newTestPKI(t, "rabbitmq.test")
+	defer pki.Remove()
+	other := newTestPKI(t, "rabbitmq.test")
+	defer other.Remove()
+
+	serverCert, err := tls.LoadX509KeyPair(pki.ServerCert, pki.ServerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{serverCert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	_, err = dialBroker("amqps://"+ln.Addr().String()+"/",
+		&brokerOptions{CAFile: other.CAFile, ServerName: "rabbitmq.test", Timeout: 5 * time.Second})
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+	if got, want := err.Error(), "certificate signed by unknown authority"; !strings.Contains(got, want) {
+		t.Errorf("Expected error containing '%s', got: '%s'", want, got)
+	}
+}
+
+// negotiateSASL reads AMQP protocol header, sends connection.start offering
+// mechanisms and returns the mechanism chosen in client's connection.start-ok
+func negotiateSASL(conn net.Conn, mechanisms string) (string, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if !bytes.Equal(header, []byte("AMQP\x00\x00\x09\x01")) {
+		return "", io.ErrUnexpectedEOF
+	}
+
+	payload := new(bytes.Buffer)
+	binary.Write(payload, binary.BigEndian, uint16(10)) // connection class
+	binary.Write(payload, binary.BigEndian, uint16(10)) // start method
+	payload.Write([]byte{0, 9})                         // protocol version
+	binary.Write(payload, binary.BigEndian, uint32(0))  // server properties
+	binary.Write(payload, binary.BigEndian, uint32(len(mechanisms)))
+	payload.WriteString(mechanisms)
+	binary.Write(payload, binary.BigEndian, uint32(5))
+	payload.WriteString("en_US")
+
+	frame := new(bytes.Buffer)
+	frame.WriteByte(1) // method frame
+	binary.Write(frame, binary.BigEndian, uint16(0))
+	binary.Write(frame, binary.BigEndian, uint32(payload.Len()))
+	frame.Write(payload.Bytes())
+	frame.WriteByte(0xCE)
+	if _, err := conn.Write(frame.Bytes()); err != nil {
+		return "", err
+	}
+
+	frameHeader := make([]byte, 7)
+	if _, err := io.ReadFull(conn, frameHeader); err != nil {
+		return "", err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(frameHeader[3:])+1)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return "", err
+	}
+	// skip class and method ids, client properties table
+	offset := 4
+	offset += 4 + int(binary.BigEndian.Uint32(body[offset:]))
+	size := int(body[offset])
+	return string(body[offset+1 : offset+1+size]), nil
+}